@@ -2,15 +2,18 @@ package flags
 
 import (
 	"fmt"
+	"os"
 	"strings"
 
 	"github.com/aquasecurity/tracee/pkg/capabilities"
 	tracee "github.com/aquasecurity/tracee/pkg/ebpf"
+	"github.com/urfave/cli/v2"
 )
 
 func capabilitiesHelp() string {
 
 	availCaps := strings.Join(capabilities.ListAvailCaps(), "\n  ")
+	availGroups := "group:" + strings.Join(capabilities.ListGroups(), "\n  group:")
 
 	return `
 Opt out from dropping capabilities by default OR set specific ones.
@@ -19,9 +22,41 @@ Possible options:
   --capabilities bypass=[true|false]        | keep all capabilities during execution time.
   --capabilities add="cap_kill,cap_syslog"  | add specific capabilities to the "required" capabilities ring.
   --capabilities drop="cap_chown"           | drop specific capabilities from the "required" capabilities ring.
+  --capabilities add="group:bpf,cap_kill"   | capabilities groups can be given instead of capabilities.
+  --capabilities required                   | print the capabilities tracee requires on this host (for the given events
+                                            | and capabilities options), and exit.
 
 Available capabilities:
-` + "  " + availCaps + "\n"
+` + "  " + availCaps + `
+
+Available capabilities groups:
+` + "  " + availGroups + "\n"
+}
+
+// PrintAndExitIfRequired prints the capabilities tracee requires on this host
+// for the given configuration (to be granted to its container, for example) if
+// "--capabilities required" is given, and exits. Only the capabilities are
+// printed to stdout, so they can be piped.
+func PrintAndExitIfRequired(ctx *cli.Context, cfg tracee.Config) {
+	required := false
+	for _, slice := range ctx.StringSlice("capabilities") {
+		if slice == "required" {
+			required = true
+		}
+	}
+	if !required {
+		return
+	}
+
+	values, err := tracee.RequiredCapabilities(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, v := range values {
+		fmt.Println(v)
+	}
+	os.Exit(0)
 }
 
 func PrepareCapabilities(capsSlice []string) (tracee.CapabilitiesConfig, error) {
@@ -134,6 +134,8 @@ func main() {
 			}
 			cfg.Filter = &filter
 
+			flags.PrintAndExitIfRequired(c, cfg)
+
 			// Check if container mode is enabled
 
 			containerMode := (cfg.Filter.ContFilter.Enabled() && cfg.Filter.ContFilter.Value()) ||
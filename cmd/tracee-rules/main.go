@@ -46,9 +46,14 @@ func main() {
 		Usage: "A rule engine for Runtime Security",
 		Action: func(c *cli.Context) error {
 
-			// Capabilities command line flags
+			// Capabilities command line flags (no eBPF objects are loaded,
+			// so no capabilities are required)
 
-			err := capabilities.Initialize(c.Bool("allcaps"))
+			err := capabilities.Initialize(
+				c.Bool("allcaps"),
+				capabilities.Features(),
+				capabilities.NoDefaultBase(true),
+			)
 			if err != nil {
 				return err
 			}
@@ -1,6 +1,6 @@
 module github.com/aquasecurity/tracee
 
-go 1.17
+go 1.18
 
 require (
 	github.com/Masterminds/sprig/v3 v3.2.2
@@ -0,0 +1,167 @@
+package capabilities
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aquasecurity/tracee/pkg/logger"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+var getAmbient = cap.GetAmbient // variable so tests can simulate ambient sets
+var setAmbient = cap.SetAmbient // variable so tests don't change the ambient set
+
+// HasAmbient tells whether the given capability is in the ambient set of the
+// calling thread (the set inherited by exec()ed programs).
+func HasAmbient(v cap.Value) (bool, error) {
+	on, err := getAmbient(v)
+	if err != nil {
+		return false, couldNotGetAmbient(v, err)
+	}
+
+	return on, nil
+}
+
+// ListAmbient returns the capabilities in the ambient set of the calling
+// thread. It helps verifying that ambient capabilities, set for an exec()ed
+// child, are in place.
+func ListAmbient() ([]cap.Value, error) {
+	var ambient []cap.Value
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		on, err := HasAmbient(v)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			ambient = append(ambient, v)
+		}
+	}
+
+	return ambient, nil
+}
+
+// SetAmbient raises the given capabilities in the inheritable and ambient sets,
+// of all threads, so programs exec()ed by tracee keep them even if they have no
+// file capabilities. The capabilities must be permitted and, since the ambient
+// set needs the inheritable one, still in the bounding set. Neither set is
+// changed in a dry run (see DryRun).
+func (c *Capabilities) SetAmbient(values ...cap.Value) (err error) {
+	err = validValues(values...)
+	if err != nil {
+		return err
+	}
+
+	managed, err := c.enter()
+	if !managed {
+		return err
+	}
+	defer c.leave(&err)
+
+	err = c.getProc()
+	if err != nil {
+		return err
+	}
+
+	notPermitted, notBound := c.notInheritable(values...)
+	if len(notPermitted) > 0 {
+		return couldNotSetAmbient(notPermitted, errors.New("not permitted"))
+	}
+	if len(notBound) > 0 {
+		return couldNotSetAmbient(notBound, errors.New("dropped from the bounding set"))
+	}
+
+	err = c.have.SetFlag(cap.Inheritable, true, values...)
+	if err != nil {
+		return couldNotSetAmbient(values, err)
+	}
+	err = c.setProc()
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		if !c.opts.quiet {
+			logger.Info("dry run, not setting ambient capabilities", "pkg", pkgName, "caps", capNames(values))
+		}
+		return nil
+	}
+
+	err = setAmbient(true, values...)
+	if err != nil {
+		return couldNotSetAmbient(values, err)
+	}
+
+	return nil
+}
+
+// SetInheritable raises the given capabilities in the inheritable set, of all
+// threads, leaving the ambient set alone (see SetAmbient). Inheritable
+// capabilities only reach capability-aware programs: on exec(), the kernel
+// grants the new program, in its permitted set, the intersection of the
+// inheritable set and the file inheritable capabilities of the program (see
+// SetFileCaps). The capabilities must be permitted and still in the bounding
+// set.
+func (c *Capabilities) SetInheritable(values ...cap.Value) (err error) {
+	err = validValues(values...)
+	if err != nil {
+		return err
+	}
+
+	managed, err := c.enter()
+	if !managed {
+		return err
+	}
+	defer c.leave(&err)
+
+	err = c.getProc()
+	if err != nil {
+		return err
+	}
+
+	notPermitted, notBound := c.notInheritable(values...)
+	if len(notPermitted) > 0 {
+		return couldNotSetInheritable(notPermitted, errors.New("not permitted"))
+	}
+	if len(notBound) > 0 {
+		return couldNotSetInheritable(notBound, errors.New("dropped from the bounding set"))
+	}
+
+	err = c.have.SetFlag(cap.Inheritable, true, values...)
+	if err != nil {
+		return couldNotSetInheritable(values, err)
+	}
+
+	return c.setProc()
+}
+
+// notInheritable returns the given capabilities that can't be made
+// inheritable: the ones not permitted and the ones dropped from the bounding
+// set.
+func (c *Capabilities) notInheritable(values ...cap.Value) (notPermitted, notBound []cap.Value) {
+	for _, v := range values {
+		permitted, err := c.have.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			notPermitted = append(notPermitted, v)
+			continue
+		}
+		bound, err := c.proc().GetBound(v)
+		if err != nil || !bound {
+			notBound = append(notBound, v)
+		}
+	}
+
+	return notPermitted, notBound
+}
+
+func couldNotGetAmbient(v cap.Value, e error) error {
+	return fmt.Errorf("could not get ambient capability %v: %w", v, e)
+}
+
+func couldNotSetAmbient(values []cap.Value, e error) error {
+	return fmt.Errorf("could not set ambient capabilities %v: %w", capNames(values), e)
+}
+
+func couldNotSetInheritable(values []cap.Value, e error) error {
+	return fmt.Errorf("could not set inheritable capabilities %v: %w", capNames(values), e)
+}
@@ -0,0 +1,105 @@
+package capabilities
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// fakeAmbient replaces the process ambient set, for the test duration, with
+// the returned one.
+func fakeAmbient(t *testing.T) map[cap.Value]bool {
+	ambient := make(map[cap.Value]bool)
+
+	oldGet, oldSet := getAmbient, setAmbient
+	t.Cleanup(func() { getAmbient, setAmbient = oldGet, oldSet })
+	getAmbient = func(v cap.Value) (bool, error) {
+		if v >= cap.MaxBits() {
+			return false, errors.New("invalid argument")
+		}
+		return ambient[v], nil
+	}
+	setAmbient = func(enable bool, values ...cap.Value) error {
+		for _, v := range values {
+			ambient[v] = enable
+		}
+		return nil
+	}
+
+	return ambient
+}
+
+func TestAmbient(t *testing.T) {
+	ambient := fakeAmbient(t)
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	before, err := ListAmbient()
+	require.NoError(t, err)
+	assert.Empty(t, before)
+
+	b.bound[cap.NET_ADMIN] = true // dropped by initialize, as not required
+	require.NoError(t, c.SetAmbient(cap.NET_ADMIN))
+	assert.Equal(t, map[cap.Value]bool{cap.NET_ADMIN: true}, ambient)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, stateOf(b.set).Inheritable)
+
+	on, err := HasAmbient(cap.NET_ADMIN)
+	require.NoError(t, err)
+	assert.True(t, on)
+
+	after, err := ListAmbient()
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, after)
+	assert.Equal(t, after, c.Info().Ambient)
+
+	_, err = HasAmbient(cap.MaxBits())
+	assert.Error(t, err)
+}
+
+func TestSetAmbientValidation(t *testing.T) {
+	c := newFakeCapabilities(t, cap.NET_ADMIN)
+
+	oldPID, oldBound := getPID, getBound
+	defer func() { getPID, getBound = oldPID, oldBound }()
+	getPID = func(int) (*cap.Set, error) { return c.have, nil }
+	getBound = func(v cap.Value) (bool, error) { return v != cap.NET_ADMIN, nil }
+
+	err := c.SetAmbient(cap.NET_ADMIN, cap.NET_RAW)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "[cap_net_raw]")
+	assert.Contains(t, err.Error(), "not permitted")
+
+	err = c.SetAmbient(cap.NET_ADMIN)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "[cap_net_admin]")
+	assert.Contains(t, err.Error(), "bounding set")
+
+	assert.ErrorContains(t, c.SetAmbient(cap.MaxBits()), "out of range")
+
+	on, err := c.have.GetFlag(cap.Inheritable, cap.NET_ADMIN)
+	require.NoError(t, err)
+	assert.False(t, on)
+}
+
+func TestSetInheritable(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.DAC_OVERRIDE)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	err := c.SetInheritable(cap.DAC_OVERRIDE, cap.NET_RAW)
+	assert.EqualError(t, err, "could not set inheritable capabilities [cap_net_raw]: not permitted")
+	err = c.SetInheritable(cap.DAC_OVERRIDE)
+	assert.EqualError(t, err, "could not set inheritable capabilities [cap_dac_override]: dropped from the bounding set")
+
+	b.bound[cap.DAC_OVERRIDE] = true
+	require.NoError(t, c.SetInheritable(cap.DAC_OVERRIDE))
+	assert.Equal(t, []cap.Value{cap.DAC_OVERRIDE}, stateOf(b.set).Inheritable)
+	assert.Empty(t, b.effective())
+
+	assert.Error(t, c.SetInheritable(cap.MaxBits()))
+	assert.NoError(t, (&Capabilities{bypass: true}).SetInheritable(cap.DAC_OVERRIDE))
+}
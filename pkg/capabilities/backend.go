@@ -0,0 +1,42 @@
+package capabilities
+
+import "kernel.org/pub/linux/libs/security/libcap/cap"
+
+// backend reads and changes the process capabilities. Capability sets are plain
+// values, that can be read and changed (their flags) without privileges: only
+// the process capabilities need a backend, which tests might replace to run
+// without privileges.
+type backend interface {
+	GetProc() (*cap.Set, error)          // capabilities of the calling thread
+	SetProc(set *cap.Set) error          // capabilities of all threads
+	GetBound(v cap.Value) (bool, error)  // whether in the bounding set
+	DropBound(values ...cap.Value) error // drop from the bounding set
+}
+
+// libcap is the backend changing the real process capabilities.
+type libcap struct{}
+
+func (libcap) GetProc() (*cap.Set, error) {
+	return getPID(0)
+}
+
+func (libcap) SetProc(set *cap.Set) error {
+	return set.SetProc()
+}
+
+func (libcap) GetBound(v cap.Value) (bool, error) {
+	return getBound(v)
+}
+
+func (libcap) DropBound(values ...cap.Value) error {
+	return dropBound(values...)
+}
+
+// proc returns the backend of the process capabilities.
+func (c *Capabilities) proc() backend {
+	if c.backend == nil {
+		return libcap{}
+	}
+
+	return c.backend
+}
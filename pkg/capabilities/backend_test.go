@@ -0,0 +1,239 @@
+package capabilities
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// fakeBackend is a backend simulating the process capabilities, enforcing the
+// kernel rules tracee depends on, so rings can be tested without privileges.
+type fakeBackend struct {
+	mu      sync.Mutex
+	set     *cap.Set
+	bound   map[cap.Value]bool
+	unknown map[cap.Value]bool // not supported by the simulated kernel
+}
+
+// newFakeBackend returns a fake backend with the given capabilities permitted
+// and effective (like a freshly executed process), and all of them bounded.
+func newFakeBackend(t testing.TB, permitted ...cap.Value) *fakeBackend {
+	t.Helper()
+
+	b := &fakeBackend{set: cap.NewSet(), bound: make(map[cap.Value]bool)}
+	require.NoError(t, b.set.SetFlag(cap.Permitted, true, permitted...))
+	require.NoError(t, b.set.SetFlag(cap.Effective, true, permitted...))
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		b.bound[v] = true
+	}
+
+	return b
+}
+
+func (b *fakeBackend) GetProc() (*cap.Set, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.set.Dup()
+}
+
+func (b *fakeBackend) SetProc(set *cap.Set) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		was, _ := b.set.GetFlag(cap.Permitted, v)
+		permitted, _ := set.GetFlag(cap.Permitted, v)
+		effective, _ := set.GetFlag(cap.Effective, v)
+		if (permitted && !was) || (effective && !permitted) {
+			return errors.New("operation not permitted")
+		}
+	}
+
+	dup, err := set.Dup()
+	if err != nil {
+		return err
+	}
+	b.set = dup
+
+	return nil
+}
+
+func (b *fakeBackend) GetBound(v cap.Value) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.unknown[v] {
+		return false, errors.New("invalid argument")
+	}
+
+	return b.bound[v], nil
+}
+
+func (b *fakeBackend) DropBound(values ...cap.Value) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, v := range values {
+		b.bound[v] = false
+	}
+
+	return nil
+}
+
+// newSeededCapabilities returns capabilities initialized from the given process
+// capabilities, with the given ones unknown to the kernel, without any side
+// effect on the test process (see fakeBackend). The initialization error, if
+// any, is returned along with the instance.
+func newSeededCapabilities(t testing.TB, set *cap.Set, unknown []cap.Value, opts ...Option) (*Capabilities, error) {
+	t.Helper()
+
+	b := newFakeBackend(t)
+	dup, err := set.Dup()
+	require.NoError(t, err)
+	b.set = dup
+	b.unknown = make(map[cap.Value]bool)
+	for _, v := range unknown {
+		b.unknown[v] = true
+	}
+
+	c := &Capabilities{backend: b}
+	return c, c.initialize(false, opts...)
+}
+
+// newFakeProcess returns capabilities initialized, with the given options, on
+// a fake backend permitting the base requirement (whatever the kernel) and the
+// given capabilities.
+func newFakeProcess(t testing.TB, permitted []cap.Value, opts ...Option) (*Capabilities, *fakeBackend) {
+	t.Helper()
+
+	base := []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN}
+	b := newFakeBackend(t, append(base, permitted...)...)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, opts...))
+
+	return c, b
+}
+
+// allValues returns every capability known to the running kernel.
+func allValues() []cap.Value {
+	var all []cap.Value
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		all = append(all, v)
+	}
+
+	return all
+}
+
+// fakeKernelRelease simulates the given kernel release for the test duration.
+func fakeKernelRelease(t testing.TB, release string) {
+	old := kernelRelease
+	t.Cleanup(func() { kernelRelease = old })
+	kernelRelease = func() (string, error) { return release, nil }
+}
+
+// effective returns the simulated effective capabilities.
+func (b *fakeBackend) effective() []cap.Value {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return stateOf(b.set).Effective
+}
+
+func TestFakeBackend(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN)
+
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	assert.Empty(t, b.effective())
+	assert.False(t, b.bound[cap.NET_ADMIN])
+
+	required := c.ring(Required)
+	err := c.Required(func() error {
+		assert.Equal(t, required, b.effective())
+
+		return c.Requested(func() error {
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			return nil
+		}, cap.NET_ADMIN)
+	})
+	require.NoError(t, err)
+	assert.Empty(t, b.effective())
+
+	err = c.Requested(func() error { return nil }, cap.NET_RAW) // not permitted
+	assert.Error(t, err)
+	assert.Empty(t, b.effective())
+}
+
+func TestSeededStrategy(t *testing.T) {
+	oldRelease, oldParanoid := kernelRelease, perfEventParanoidFile
+	defer func() { kernelRelease, perfEventParanoidFile = oldRelease, oldParanoid }()
+
+	testCases := []struct {
+		name      string
+		release   string
+		paranoid  string
+		unknown   []cap.Value
+		permitted []cap.Value
+		required  []cap.Value
+		missing   bool // required capabilities not permitted
+	}{
+		{
+			name:      "cap_bpf",
+			release:   "5.15.0",
+			paranoid:  "2",
+			permitted: []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON},
+			required:  []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.PERFMON, cap.BPF},
+		},
+		{
+			name:      "cap_bpf, paranoid",
+			release:   "5.15.0",
+			paranoid:  "3",
+			permitted: []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON},
+			required:  []cap.Value{cap.IPC_LOCK, cap.SYS_ADMIN, cap.SYS_RESOURCE, cap.PERFMON, cap.BPF},
+			missing:   true,
+		},
+		{
+			name:      "backported cap_bpf",
+			release:   "4.18.0-305.el8.x86_64",
+			paranoid:  "2",
+			permitted: []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON},
+			required:  []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.PERFMON, cap.BPF},
+		},
+		{
+			name:      "no cap_bpf",
+			release:   "4.19.0",
+			paranoid:  "2",
+			unknown:   []cap.Value{cap.PERFMON, cap.BPF, cap.CHECKPOINT_RESTORE},
+			permitted: []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.SYS_ADMIN},
+			required:  []cap.Value{cap.IPC_LOCK, cap.SYS_ADMIN, cap.SYS_RESOURCE},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			release := tc.release
+			kernelRelease = func() (string, error) { return release, nil }
+			perfEventParanoidFile = filepath.Join(t.TempDir(), "perf_event_paranoid")
+			require.NoError(t, os.WriteFile(perfEventParanoidFile, []byte(tc.paranoid+"\n"), 0644))
+
+			set := cap.NewSet()
+			require.NoError(t, set.SetFlag(cap.Permitted, true, tc.permitted...))
+
+			c, err := newSeededCapabilities(t, set, tc.unknown)
+			require.NoError(t, err)
+			if tc.missing {
+				assert.ErrorIs(t, c.Validate(), ErrRequiredNotPermitted)
+			} else {
+				assert.NoError(t, c.Validate())
+			}
+			assert.Equal(t, tc.required, c.ListRequired())
+		})
+	}
+}
@@ -1,394 +1,3560 @@
 package capabilities
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/aquasecurity/libbpfgo/helpers"
 	"github.com/aquasecurity/tracee/pkg/logger"
 	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
-var once sync.Once
-var caps *Capabilities // singleton for all packages
+var initLock sync.RWMutex // serializes the initialization of the singleton
+var caps *Capabilities    // singleton for all packages
 
 const pkgName = "capabilities"
 
+// ErrTooManyElevations is returned when entering an elevated ring while too
+// many callers are already waiting to enter one (see MaxQueuedElevations).
+var ErrTooManyElevations = errors.New("too many queued elevations")
+
+// ErrRequiredNotPermitted is returned by initialization when required
+// capabilities are not in the permitted set: tracee must run with more
+// privileges. The instance is initialized nevertheless.
+var ErrRequiredNotPermitted = errors.New("required capabilities not permitted")
+
+// ErrPrivilegedBudgetExceeded is returned when entering the Privileged ring
+// after its time budget was spent (see PrivilegedTimeBudget).
+var ErrPrivilegedBudgetExceeded = errors.New("privileged time budget exceeded")
+
+// ErrAlreadyInitialized is returned when initializing the singleton again
+// (see Initialize and Restore).
+var ErrAlreadyInitialized = errors.New("capabilities already initialized")
+
+// SetProcError is returned when the process capabilities could not be changed.
+// The cause is kept: errors.Is(err, syscall.EPERM), for example, tells whether
+// the change was denied.
+type SetProcError struct {
+	Err error
+}
+
+func (e *SetProcError) Error() string {
+	return "could not set capabilities: " + e.Err.Error()
+}
+
+func (e *SetProcError) Unwrap() error {
+	return e.Err
+}
+
+// ErrLockedDown is returned when entering the Privileged or Requested rings
+// after capabilities were locked down (see LockDown): they can no longer raise
+// anything.
+var ErrLockedDown = errors.New("capabilities locked down")
+
+// ErrNotInitialized is returned when using an instance that was not initialized
+// (see Initialize).
+var ErrNotInitialized = errors.New("capabilities not initialized")
+
+var procVersionFile = "/proc/version"    // variable so tests can simulate sandboxes
+var uidMapFile = "/proc/self/uid_map"    // variable so tests can simulate user namespaces
+var getBound = cap.GetBound              // variable so tests can simulate bounding sets
+var dropBound = cap.DropBound            // variable so tests can observe bounding set drops
+var kernelRelease = helpers.UnameRelease // variable so tests can simulate kernels
+var getThreadCaps = cap.GetProc          // variable so tests can simulate threads
+var getPID = cap.GetPID                  // variable so tests can simulate procfs failures
+var getProcRetryDelay = 10 * time.Millisecond
+var setProcRetryDelay = time.Millisecond // doubled on every retry
+
+var perfEventParanoidFile = "/proc/sys/kernel/perf_event_paranoid" // variable so tests can simulate paranoia levels
+
 //
 // "Effective" might be at protection rings 0,1,2,3
 // "Permitted" is always at ring0 (so effective can migrate rings)
 // "Bound" will bet set to unprivileged so exec() can't inherit capabilities.
 //
 
-type ringType int
+// Ring is a protection ring: a set of capabilities made Effective together.
+type Ring int
+
+const (
+	Privileged   Ring = iota // ring0 (all capabilities enabled, startup/shutdown)
+	Required                 // ring1 (needed capabilities only: config time)
+	Requested                // ring2 (temporary specific capabilities)
+	Unprivileged             // ring3 (no capabilities: runtime)
+)
+
+func (t Ring) String() string {
+	switch t {
+	case Privileged:
+		return "privileged"
+	case Required:
+		return "required"
+	case Requested:
+		return "requested"
+	case Unprivileged:
+		return "unprivileged"
+	}
+
+	return "unknown"
+}
+
+// Builtin features, each requiring its own minimal capabilities.
+const (
+	FeatureBPF  = "bpf"  // loading eBPF programs and maps
+	FeaturePerf = "perf" // opening and reading perf events
+)
+
+type Capabilities struct {
+	have        *cap.Set
+	all         map[cap.Value]map[Ring]bool
+	confined    map[Ring][]cap.Value // cleared from Permitted while in the ring
+	bypass      bool
+	lock        *sync.RWMutex // big lock to guarantee all threads are on the same ring (read locked by getters)
+	onSetProc   func(CapState)
+	baseline    map[cap.Value]bool // required capabilities at the end of init
+	creep       []Creep
+	features    map[string][]cap.Value // capabilities required by each feature
+	reasons     map[cap.Value][]string // why (initialization) required capabilities are required
+	sandbox     string                 // detected sandbox environment (if any)
+	userns      bool                   // running in a non-initial user namespace
+	sealed      bool                   // required ring can't grow anymore
+	release     string                 // running kernel release
+	decisions   []Decision             // initialization decision points
+	counters    counters               // source of Stats
+	waiting     int32                  // callers waiting to enter an elevated ring
+	subs        subscribers            // ring transitions subscribers
+	phases      map[string][]cap.Value // capabilities added by each startup phase
+	phase       string                 // current startup phase
+	current     Ring                   // ring currently effective
+	owner       int32                  // thread holding the rings, 0 if none (see enter)
+	confinedTID int32                  // thread running a confined callback, 0 if none (see run)
+	frames      []frame                // rings entered, innermost last
+	original    *cap.Set               // process capabilities before initialization
+	stale       bool                   // cached capabilities (have) must be read again
+	metrics     Metrics                // ring transitions sink (if any)
+	paranoid    int                    // perf_event_paranoid detected at init (see ParanoidLevel)
+	backend     backend                // process capabilities (libcap if nil)
+	hasBPF      bool                   // kernel supports cap.BPF and cap.PERFMON
+	unsupported map[cap.Value]bool     // capabilities the kernel does not support (see reconcile)
+	ringHook    func(from, to Ring)    // called on every ring change (if any)
+	degraded    bool                   // initialization failed, rings are no-ops
+	nonFatal    []error                // initialization errors only logged
+	dryRun      bool                   // capabilities changes are only logged
+	lockedDown  bool                   // permitted set reduced to required (see LockDown)
+	seq         uint64                 // ring transitions started
+	watchdog    time.Duration          // Privileged callbacks running longer are reported
+	direct      map[cap.Value]int      // Require() calls not released yet, by capability
+	audit       io.Writer
+	auditLock   sync.Mutex // serializes audit writes
+	opts        *Options
+}
+
+// Decision is a decision point of the initialization, with the inputs it was
+// based on and its outcome (and the capabilities it required, if any).
+type Decision struct {
+	Point   string            `json:"point"`
+	Inputs  map[string]string `json:"inputs"`
+	Outcome string            `json:"outcome"`
+	Caps    []cap.Value       `json:"caps,omitempty"`
+}
+
+// scope is a ring entered by EnterRequested, until left.
+type scope struct {
+	caller string
+	left   bool
+}
+
+// frame is an entered ring, remembering what to restore when leaving it.
+type frame struct {
+	ring      Ring
+	effective map[cap.Value]bool
+	changed   bool // whether the effective set changed since entering
+}
+
+// CapState is a snapshot of the process capability sets.
+type CapState struct {
+	Effective   []cap.Value
+	Permitted   []cap.Value
+	Inheritable []cap.Value
+}
+
+// FlagDiff lists the capabilities added to, and removed from, a capability set
+// when comparing two processes.
+type FlagDiff struct {
+	Added   []cap.Value `json:"added,omitempty"`
+	Removed []cap.Value `json:"removed,omitempty"`
+}
+
+// Empty tells whether the capability set did not change.
+func (d FlagDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+// StateDiff is the difference between the capability sets of two processes.
+type StateDiff struct {
+	Effective   FlagDiff `json:"effective"`
+	Permitted   FlagDiff `json:"permitted"`
+	Inheritable FlagDiff `json:"inheritable"`
+	Bounding    FlagDiff `json:"bounding"`
+}
+
+// Empty tells whether both processes have the same capabilities.
+func (d StateDiff) Empty() bool {
+	return d.Effective.Empty() && d.Permitted.Empty() && d.Inheritable.Empty() && d.Bounding.Empty()
+}
+
+// CapFlagDiff lists the capabilities added to, removed from, and kept in a flag
+// of a capability set when comparing two sets (see Diff).
+type CapFlagDiff struct {
+	FlagDiff
+	Unchanged []cap.Value `json:"unchanged,omitempty"`
+}
+
+// CapDiff is the difference between two capability sets (see Diff).
+type CapDiff struct {
+	Effective   CapFlagDiff `json:"effective"`
+	Permitted   CapFlagDiff `json:"permitted"`
+	Inheritable CapFlagDiff `json:"inheritable"`
+}
+
+// Empty tells whether both sets have the same capabilities.
+func (d CapDiff) Empty() bool {
+	return d.Effective.Empty() && d.Permitted.Empty() && d.Inheritable.Empty()
+}
+
+// Creep is a growth of the Required ring after initialization.
+type Creep struct {
+	Values []cap.Value `json:"values"`
+	Caller string      `json:"caller"`
+}
+
+// Info describes the capabilities configuration of the running process.
+type Info struct {
+	Bypass           bool                   `json:"bypass"`
+	Degraded         bool                   `json:"degraded,omitempty"` // see InitializeBestEffort
+	Sandbox          string                 `json:"sandbox"`
+	UserNamespace    bool                   `json:"userNamespace,omitempty"` // see InUserNamespace
+	Required         []cap.Value            `json:"required"`
+	Features         map[string][]cap.Value `json:"features"`
+	Creep            []Creep                `json:"creep"`
+	BoundingSetEmpty bool                   `json:"boundingSetEmpty"`
+	Bound            []cap.Value            `json:"bound"`
+	Decisions        []Decision             `json:"decisions,omitempty"`
+	PrivilegedBudget *time.Duration         `json:"privilegedBudget,omitempty"` // remaining (if budgeted)
+	Securebits       *Securebits            `json:"securebits,omitempty"`
+	Phase            string                 `json:"phase,omitempty"`
+	Ambient          []cap.Value            `json:"ambient"`
+}
+
+// StateSchemaVersion is the version of the state files written by
+// DumpStateToFile. It must be increased on incompatible changes of Info.
+const StateSchemaVersion = 1
+
+// capState is the state of a capability, as dumped by DumpState.
+type capState struct {
+	Privileged   bool `json:"privileged"`
+	Required     bool `json:"required"`
+	Requested    bool `json:"requested"`
+	Unprivileged bool `json:"unprivileged"`
+	Permitted    bool `json:"permitted"`
+	Effective    bool `json:"effective"`
+}
+
+// stateDump is the content of DumpState.
+type stateDump struct {
+	Bypass   bool                `json:"bypass"`
+	Paranoid int                 `json:"perfEventParanoid"`
+	Caps     map[string]capState `json:"caps"` // by capability name
+}
+
+// stateFile is the content of a state file.
+type stateFile struct {
+	SchemaVersion int  `json:"schemaVersion"`
+	Info          Info `json:"info"`
+}
+
+// Options holds various Option items that can be passed to Initialize.
+type Options struct {
+	// OnSetProc is called, with the newly applied state, after every
+	// successful change of the process capabilities (including the ones
+	// done during initialization). It is called while holding the
+	// capabilities lock: it must be cheap and must not call back into
+	// the capabilities package.
+	OnSetProc func(CapState)
+
+	// DetectCreep enables warnings whenever the Required ring grows beyond
+	// the set of capabilities required at the end of initialization.
+	DetectCreep bool
+
+	// CaptureStack records the caller stack, instead of only the caller, of
+	// capability creeps.
+	CaptureStack bool
+
+	// SandboxBypass enables bypass mode when running under a sandbox (like
+	// gVisor) in which capabilities management is advisory only.
+	SandboxBypass bool
+
+	// Features are the builtin features (FeatureBPF, FeaturePerf) whose
+	// capabilities are required. By default all of them are.
+	Features []string
+
+	// ParanoidThreshold is the highest perf_event_paranoid value that does
+	// not require CAP_SYS_ADMIN for perf events. It must be within the
+	// documented paranoia levels (-1 to 4). By default it is 2.
+	ParanoidThreshold int
+
+	// GetProcRetries is the number of times reading the process capabilities
+	// is retried on transient failures (heavily loaded or sandboxed systems).
+	// By default it is 2.
+	GetProcRetries int
+
+	// SetProcRetries is the number of times changing the process capabilities
+	// is retried, with a short backoff, on transient failures (thread churn on
+	// heavily loaded systems). Denied changes (EPERM) are never retried. By
+	// default it is 3.
+	SetProcRetries int
+
+	// MaxQueuedElevations is the maximum number of callers waiting to enter an
+	// elevated ring (Privileged, Required or Requested). Further callers fail
+	// with ErrTooManyElevations instead of queueing. By default (0) there is
+	// no limit.
+	MaxQueuedElevations int
+
+	// PrivilegedTimeBudget is the cumulative time the process may spend in
+	// the Privileged ring. Once spent, entering the ring logs an error, or
+	// fails with ErrPrivilegedBudgetExceeded if PrivilegedBudgetFail is set.
+	// By default (0) there is no budget.
+	PrivilegedTimeBudget time.Duration
+
+	// PrivilegedBudgetFail makes entering the Privileged ring fail, instead of
+	// only logging, once the PrivilegedTimeBudget is spent.
+	PrivilegedBudgetFail bool
+
+	// WarnExcessPermitted logs an advisory, at the end of initialization, if
+	// the permitted set has capabilities tracee will never need (see
+	// AllPotentialCaps).
+	WarnExcessPermitted bool
+
+	// KeepBounded are the capabilities kept in the bounding set, which is
+	// otherwise emptied at initialization, so exec()ed privileged helpers
+	// can still gain them. Keeping bounding entries weakens the hardening
+	// of exec()ed programs.
+	KeepBounded []cap.Value
+
+	// NoNewPrivs sets no_new_privs at initialization (see EnableNoNewPrivs).
+	NoNewPrivs bool
+
+	// BaseRequired are capabilities required on top of the default base
+	// requirement (CAP_IPC_LOCK and CAP_SYS_RESOURCE, for locking eBPF maps
+	// memory) and of the capabilities required by Features.
+	BaseRequired []cap.Value
+
+	// NoDefaultBase drops the default base requirement, for deployments not
+	// locking memory. Features (and perf_event_paranoid) still apply.
+	NoDefaultBase bool
+
+	// DebugVerifyThreads is a debugging aid verifying, after every ring
+	// transition, that all threads of the process (as listed in
+	// /proc/self/task) have the applied Effective capabilities, like
+	// PrivilegedAllThreads does for its ring. Rings are process wide already:
+	// libcap (through psx) changes the capabilities of all threads. It costs
+	// reading procfs for every thread on each transition, so it is not meant
+	// for production.
+	DebugVerifyThreads bool
+
+	// DryRun only logs the capabilities changes that would be made, never
+	// changing the process capabilities nor the bounding set. Rings are
+	// still tracked (see EffectiveRing), validating a configuration on
+	// machines without privileges.
+	DryRun bool
+
+	quiet bool // dry run changes are not logged (see MinimalCapsFor)
+}
+
+type Option func(*Options)
+
+func OnSetProc(fn func(CapState)) Option {
+	return func(o *Options) {
+		o.OnSetProc = fn
+	}
+}
+
+func DetectCreep(detect bool) Option {
+	return func(o *Options) {
+		o.DetectCreep = detect
+	}
+}
+
+func CaptureStack(capture bool) Option {
+	return func(o *Options) {
+		o.CaptureStack = capture
+	}
+}
+
+func SandboxBypass(bypass bool) Option {
+	return func(o *Options) {
+		o.SandboxBypass = bypass
+	}
+}
+
+func Features(features ...string) Option {
+	return func(o *Options) {
+		o.Features = features
+	}
+}
+
+func ParanoidThreshold(threshold int) Option {
+	return func(o *Options) {
+		o.ParanoidThreshold = threshold
+	}
+}
+
+func GetProcRetries(retries int) Option {
+	return func(o *Options) {
+		o.GetProcRetries = retries
+	}
+}
+
+func SetProcRetries(retries int) Option {
+	return func(o *Options) {
+		o.SetProcRetries = retries
+	}
+}
+
+func MaxQueuedElevations(max int) Option {
+	return func(o *Options) {
+		o.MaxQueuedElevations = max
+	}
+}
+
+func PrivilegedTimeBudget(budget time.Duration) Option {
+	return func(o *Options) {
+		o.PrivilegedTimeBudget = budget
+	}
+}
+
+func PrivilegedBudgetFail(fail bool) Option {
+	return func(o *Options) {
+		o.PrivilegedBudgetFail = fail
+	}
+}
+
+func WarnExcessPermitted(warn bool) Option {
+	return func(o *Options) {
+		o.WarnExcessPermitted = warn
+	}
+}
+
+func KeepBounded(values ...cap.Value) Option {
+	return func(o *Options) {
+		o.KeepBounded = values
+	}
+}
+
+func NoNewPrivs(enable bool) Option {
+	return func(o *Options) {
+		o.NoNewPrivs = enable
+	}
+}
+
+func BaseRequired(values ...cap.Value) Option {
+	return func(o *Options) {
+		o.BaseRequired = values
+	}
+}
+
+func NoDefaultBase(skip bool) Option {
+	return func(o *Options) {
+		o.NoDefaultBase = skip
+	}
+}
+
+func DebugVerifyThreads(verify bool) Option {
+	return func(o *Options) {
+		o.DebugVerifyThreads = verify
+	}
+}
+
+func DryRun(dryRun bool) Option {
+	return func(o *Options) {
+		o.DryRun = dryRun
+	}
+}
+
+func newDefaultOptions() *Options {
+	return &Options{
+		Features:          []string{FeatureBPF, FeaturePerf},
+		ParanoidThreshold: 2,
+		GetProcRetries:    2,
+		SetProcRetries:    3,
+	}
+}
+
+// Initialize initializes the "caps" instance (singleton). Initializing it again
+// fails with ErrAlreadyInitialized. If initialization fails, the singleton is
+// left uninitialized and Initialize can be called again. Required capabilities
+// being permitted is checked later, once all requirements are known (see
+// Validate).
+func Initialize(bypass bool, opts ...Option) error {
+	initLock.Lock()
+	defer initLock.Unlock()
+
+	if caps != nil {
+		return ErrAlreadyInitialized
+	}
+
+	c := &Capabilities{}
+	err := c.initialize(bypass, opts...)
+	if err != nil {
+		return err
+	}
+	caps = c
+
+	return nil
+}
+
+// InitializeBestEffort is like Initialize but never fails: initialization
+// errors, fatal or not, are returned and, if initialization could not complete
+// (in restricted containers lacking cap.SETPCAP, for example), the instance is
+// degraded: rings run their callbacks without changing capabilities, as when
+// bypassing. Required capabilities not being permitted is not fatal.
+func InitializeBestEffort(bypass bool, opts ...Option) (*Capabilities, []error) {
+	initLock.Lock()
+	defer initLock.Unlock()
+
+	if caps != nil {
+		return caps, []error{ErrAlreadyInitialized}
+	}
+
+	c := &Capabilities{}
+	errs := c.initializeBestEffort(bypass, opts...)
+	caps = c
+
+	return caps, errs
+}
+
+// MinimalCapsFor returns, sorted, the capabilities tracee requires on the
+// running host with the given options, so operators can grant exactly them (to
+// containers...). The decisions of initialization are taken (base requirement,
+// kernel support of cap.BPF, perf_event_paranoid), but nothing is applied (nor
+// logged as a dry run would).
+func MinimalCapsFor(opts ...Option) ([]cap.Value, error) {
+	c := &Capabilities{}
+
+	err := c.initialize(false, append(opts, func(o *Options) {
+		o.DryRun = true
+		o.quiet = true
+		o.SandboxBypass = false
+		o.NoNewPrivs = false
+		o.OnSetProc = nil
+	})...)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.ListRequired(), nil
+}
+
+// Restore re-applies the process capabilities as they were before
+// initialization and, for the singleton, allows Initialize to be called again.
+// Capabilities dropped from the bounding set can't be restored. It must not be
+// called from a ring callback. Restoring twice does nothing.
+func (c *Capabilities) Restore() error {
+	if !c.initialized() {
+		return couldNotUseUninitialized()
+	}
+
+	if !c.bypass {
+		if c.holding() {
+			return couldNotRestore(errors.New("called from a ring callback"))
+		}
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if c.original != nil {
+			c.have = c.original
+			err := c.setProc()
+			if err != nil {
+				return err
+			}
+			c.original = nil
+		}
+	}
+
+	initLock.Lock()
+	if caps == c {
+		caps = nil
+	}
+	initLock.Unlock()
+
+	return nil
+}
+
+// GetInstance returns current "caps" instance. It initializes capabilities if
+// needed, bypassing the privilege dropping by default.
+func GetInstance() *Capabilities {
+	initLock.RLock()
+	c := caps
+	initLock.RUnlock()
+
+	if c == nil {
+		err := Initialize(true)
+		if err != nil && !errors.Is(err, ErrAlreadyInitialized) {
+			return nil
+		}
+
+		initLock.RLock()
+		c = caps
+		initLock.RUnlock()
+	}
+	return c
+}
+
+func (c *Capabilities) initialize(bypass bool, opts ...Option) error {
+	options := newDefaultOptions()
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if options.ParanoidThreshold < MinParanoiaLevel || options.ParanoidThreshold > MaxParanoiaLevel {
+		return couldNotUseParanoidThreshold(options.ParanoidThreshold)
+	}
+	if options.MaxQueuedElevations < 0 {
+		return couldNotUseMaxQueuedElevations(options.MaxQueuedElevations)
+	}
+
+	c.opts = options
+	c.onSetProc = options.OnSetProc
+	c.dryRun = options.DryRun
+
+	// Sandboxes, like gVisor, might intercept capabilities related syscalls,
+	// making them succeed without any real effect.
+
+	c.sandbox = detectSandbox(procVersionFile)
+	if c.sandbox != "" {
+		logger.Warn("running under a sandbox, capabilities management may be advisory only", "pkg", pkgName, "sandbox", c.sandbox)
+		if options.SandboxBypass {
+			logger.Warn("sandbox detected, bypassing capabilities management", "pkg", pkgName)
+			bypass = true
+		}
+	}
+
+	// In user namespaces (rootless containers) capabilities only apply to the
+	// namespace: the kernel checks eBPF and perf capabilities against the
+	// initial one, so they are not effective for them.
+
+	c.userns = InUserNamespace()
+	if c.userns {
+		logger.Warn("running in a user namespace, capabilities are not effective on the host", "pkg", pkgName)
+	}
+
+	outcome := "manage capabilities"
+	if bypass {
+		outcome = "bypass"
+	}
+	c.decide("bypass", outcome, map[string]string{
+		"bypass":        strconv.FormatBool(bypass),
+		"sandbox":       c.sandbox,
+		"sandboxBypass": strconv.FormatBool(options.SandboxBypass),
+	})
+
+	if bypass {
+		c.bypass = true
+		return nil
+	}
+
+	var err error
+
+	c.lock = new(sync.RWMutex)
+	c.all = make(map[cap.Value]map[Ring]bool)
+	c.confined = make(map[Ring][]cap.Value)
+	c.features = make(map[string][]cap.Value)
+	c.reasons = make(map[cap.Value][]string)
+
+	c.release, err = kernelRelease()
+	if err != nil {
+		logger.Debug("could not get kernel release", "pkg", pkgName, "error", err)
+	}
+	c.decide("kernel", "release "+c.release, map[string]string{"release": c.release})
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		c.all[v] = make(map[Ring]bool)
+		c.all[v][Privileged] = true // all capabilities are enabled
+		// Required, Requested and Unprivileged is false by default
+	}
+
+	err = c.getProc()
+	if err != nil {
+		return err
+	}
+	c.original, err = c.have.Dup()
+	if err != nil {
+		return couldNotGetProc(err)
+	}
+
+	c.reconcile()
+
+	keep := make(map[cap.Value]bool)
+	for _, v := range options.KeepBounded {
+		keep[v] = true
+	}
+	if len(keep) > 0 {
+		logger.Warn("keeping capabilities in the bounding set, exec()ed programs may gain them", "pkg", pkgName,
+			"caps", capNames(options.KeepBounded))
+	}
+
+	if c.dryRun && !c.opts.quiet {
+		logger.Info("dry run, not emptying the bounding set", "pkg", pkgName)
+	}
+
+	var notDropped []cap.Value
+	var dropErr error
+	for v := range c.all {
+		if keep[v] || c.dryRun {
+			continue
+		}
+		err = c.proc().DropBound(v) // drop all capabilities from bound
+		if err != nil {
+			notDropped = append(notDropped, v)
+			dropErr = err
+			c.nonFatal = append(c.nonFatal, couldNotDropBound(v, err))
+		}
+	}
+	if len(notDropped) > 0 { // once, as all of them usually fail (no CAP_SETPCAP)
+		sortValues(notDropped)
+		logger.Warn("could not drop capabilities from bounding set", "pkg", pkgName,
+			"caps", capNames(notDropped), "error", dropErr)
+	}
+
+	err = c.setProc()
+	if err != nil {
+		return err
+	}
+
+	if options.NoNewPrivs {
+		err = c.EnableNoNewPrivs()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The base for required capabilities (ring1) depends on the following:
+
+	var base []cap.Value
+	if !options.NoDefaultBase {
+		base = append(base, cap.IPC_LOCK, cap.SYS_RESOURCE)
+	}
+	base = append(base, options.BaseRequired...)
+
+	err = c.Require(base...)
+	if err != nil {
+		return err
+	}
+	c.because("base requirement", base...)
+	outcome = "no base requirement"
+	if len(base) > 0 {
+		outcome = "require " + strings.Join(capNames(base), ",")
+	}
+	c.decide("base", outcome, map[string]string{
+		"defaultBase":  strconv.FormatBool(!options.NoDefaultBase),
+		"baseRequired": strings.Join(capNames(options.BaseRequired), ","),
+	}, base...)
+
+	// Kernels bellow v5.8 do not support cap.BPF + cap.PERFMON (instead of
+	// having to have cap.SYS_ADMIN), nevertheless, some kernels, like RHEL8
+	// clones, have backported cap.BPF capability and might be able to use it.
+	// Only the capabilities needed by enabled features are required: loading
+	// eBPF objects needs cap.BPF and perf events need cap.PERFMON.
+
+	var support string
+	c.hasBPF, support = c.bpfSupport()
+
+	strategy := "strategy: kernel supports CAP_BPF (" + support + "), CAP_BPF and CAP_PERFMON used instead of CAP_SYS_ADMIN"
+	if !c.hasBPF {
+		strategy = "strategy: kernel does not support CAP_BPF, CAP_SYS_ADMIN used instead of CAP_BPF and CAP_PERFMON"
+	}
+	if c.userns {
+		strategy += " (user namespace, neither grants eBPF on the host)"
+	}
+	c.decide("strategy", strings.TrimPrefix(strategy, "strategy: "), map[string]string{
+		"release":       c.release,
+		"capBPFSupport": support,
+		"userNamespace": strconv.FormatBool(c.userns),
+	})
+
+	for _, feature := range options.Features {
+		values, err := builtinFeatureCaps(feature, c.hasBPF)
+		if err != nil {
+			return err
+		}
+		err = c.RequireForFeature(feature, values...)
+		if err != nil {
+			return err
+		}
+		c.because(strategy, values...)
+		c.decide("feature", "require "+strings.Join(capNames(values), ","), map[string]string{
+			"feature":       feature,
+			"capBPFSupport": support,
+		}, values...)
+	}
+
+	paranoid, err := getKernelPerfEventParanoidValue(perfEventParanoidFile)
+	if err != nil {
+		logger.Debug("could not get perf_event_paranoid, assuming highest", "pkg", pkgName)
+		c.nonFatal = append(c.nonFatal, err)
+		c.paranoid = UnknownParanoiaLevel
+	} else {
+		logger.Debug("perf_event_paranoid detected", "pkg", pkgName, "level", paranoid)
+		c.paranoid = paranoid
+	}
+
+	err = c.requireForParanoid(paranoid)
+	if err != nil {
+		return err
+	}
+
+	c.baseline = make(map[cap.Value]bool)
+	for v, rings := range c.all {
+		if rings[Required] {
+			c.baseline[v] = true
+		}
+	}
+	if c.userns {
+		logger.Warn("required capabilities won't be effective on the host, loading eBPF programs may fail", "pkg", pkgName,
+			"caps", capNames(c.ring(Required)))
+	}
+
+	if options.WarnExcessPermitted {
+		c.adviseExcessPermitted()
+	}
+
+	return c.apply(Unprivileged) // ring3 as effective
+}
+
+// initializeBestEffort initializes capabilities, degrading the instance if it
+// fails, and returns all errors met.
+func (c *Capabilities) initializeBestEffort(bypass bool, opts ...Option) []error {
+	err := c.initialize(bypass, opts...)
+
+	errs := append([]error{}, c.nonFatal...)
+	if err == nil {
+		if !c.bypass {
+			err = c.checkRequiredPermitted()
+		}
+		if err != nil {
+			errs = append(errs, err) // not fatal
+		}
+		return errs
+	}
+	errs = append(errs, err)
+
+	logger.Warn("could not initialize capabilities, running degraded (capabilities unmanaged)", "pkg", pkgName, "error", err)
+	c.bypass = true
+	c.degraded = true
+
+	return errs
+}
+
+// Public Methods
+
+// Privileged is a protection ring with all caps set as Effective.
+func (c *Capabilities) Privileged(cb func() error) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer c.leave(&err) // back to the previous ring
+
+		if c.lockedDown {
+			return couldNotEnterLockedDown(Privileged)
+		}
+		err = c.checkPrivilegedBudget()
+		if err != nil {
+			return err
+		}
+
+		err = c.apply(Privileged) // ring0 as effective for callback exec
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Privileged, cb) // callback
+}
+
+// PrivilegedCtx is like Privileged() but the context is passed through to the
+// callback. If the context is already done, its error is returned without any
+// ring change.
+func (c *Capabilities) PrivilegedCtx(ctx context.Context, cb func(context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.Privileged(func() error {
+		return cb(ctx)
+	})
+}
+
+// PrivilegedAllThreads is like Privileged() but, before running the callback
+// and after leaving the ring, it verifies that every OS thread of the process
+// (as listed in /proc/self/task) has the expected Effective capabilities. It is
+// meant for the rare cases in which privileged work genuinely spans threads.
+//
+// NOTE: libcap (through psx) already changes capabilities of all threads, this
+// is an additional and costly check: procfs is read for every thread in each
+// transition. Threads created while checking are not verified (but inherit the
+// capabilities of their creators).
+func (c *Capabilities) PrivilegedAllThreads(cb func() error) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer func() {
+			c.leave(&err) // back to the previous ring
+			if err == nil {
+				err = c.verifyAllThreads()
+			}
+		}()
+
+		if c.lockedDown {
+			return couldNotEnterLockedDown(Privileged)
+		}
+		err = c.checkPrivilegedBudget()
+		if err != nil {
+			return err
+		}
+
+		err = c.apply(Privileged) // ring0 as effective for callback exec
+		if err != nil {
+			return err
+		}
+		err = c.verifyAllThreads()
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Privileged, cb) // callback
+}
+
+// PrivilegedGuarded is like Privileged() but it also holds the given external
+// lock, protecting the caller own state, while the callback runs. Locks are
+// always acquired in the same order: first the external lock, then the ring.
+//
+// NOTE: To avoid lock ordering deadlocks, callers sharing a lock with elevated
+// code must never enter a ring while holding it, other than through this
+// function, and must never acquire it from within a ring callback.
+func (c *Capabilities) PrivilegedGuarded(extLock sync.Locker, cb func() error) error {
+	extLock.Lock()
+	defer extLock.Unlock()
+
+	return c.Privileged(cb)
+}
+
+// Required is a protection ring with only the required caps set as Effective.
+func (c *Capabilities) Required(cb func() error) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer c.leave(&err) // back to the previous ring
+
+		err = c.apply(Required) // ring1 as effective
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Required, cb) // callback
+}
+
+// RequiredCtx is like Required() but the context is passed through to the
+// callback. If the context is already done, its error is returned without any
+// ring change.
+func (c *Capabilities) RequiredCtx(ctx context.Context, cb func(context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.Required(func() error {
+		return cb(ctx)
+	})
+}
+
+// RequiredDeadline is like Required() but it warns, dumping all goroutines
+// stacks, if the callback is still running by the deadline of the given context.
+// The callback is never interrupted (and the ring is always restored).
+func (c *Capabilities) RequiredDeadline(ctx context.Context, cb func() error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return c.Required(cb)
+	}
+
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		buf := make([]byte, 64*1024)
+		logger.Warn("required ring callback exceeded its deadline", "pkg", pkgName,
+			"deadline", deadline, "stack", string(buf[:runtime.Stack(buf, true)]))
+	})
+	defer timer.Stop()
+
+	return c.Required(cb)
+}
+
+// RequiredWith is like Required() but the given extra capabilities are also set
+// as Effective, for the callback only, sparing callers from listing all required
+// capabilities (with Requested) when they need a single extra one.
+func (c *Capabilities) RequiredWith(cb func() error, extra ...cap.Value) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer c.leave(&err) // back to the previous ring
+
+		with := make(map[cap.Value]bool)
+		for _, v := range extra {
+			if c.all[v] == nil {
+				return couldNotFindCapability(NameOf(v))
+			}
+			with[v] = true
+		}
+		err = c.applyEffective(Required, func(v cap.Value) bool { // ring1 (and extra) as effective
+			return c.all[v][Required] || with[v]
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Required, cb) // callback
+}
+
+// Requested is a protection ring that needs configuration each time it is
+// called. Instead of making Required capabilities Effective, like Required(),
+// it sets as Effective only given capabilities, for a single time, until the
+// next ring is called. It is specially needed for startup/shutdown actions that
+// might require specific capabilities Effective.
+func (c *Capabilities) Requested(cb func() error, values ...cap.Value) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer c.leave(&err) // back to the previous ring
+
+		if c.lockedDown {
+			return couldNotEnterLockedDown(Requested)
+		}
+		err = c.checkPermitted(values...)
+		if err != nil {
+			return err
+		}
+		err = c.set(Requested, values...)
+		if err != nil {
+			return err
+		}
+		err = c.apply(Requested) // ring2 as effective
+		if err != nil {
+			return err
+		}
+		err = c.unset(Requested, values...) // clean requested (for next calls)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Requested, cb)
+}
+
+// RequestedCtx is like Requested() but the context is passed through to the
+// callback. If the context is already done, its error is returned without any
+// ring change.
+func (c *Capabilities) RequestedCtx(ctx context.Context, cb func(context.Context) error, values ...cap.Value) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return c.Requested(func() error {
+		return cb(ctx)
+	}, values...)
+}
+
+// RequestedBestEffort is the lenient counterpart of Requested(): only the given
+// capabilities that are permitted are set as Effective, the others are skipped.
+// The callback is told which capabilities were granted.
+func (c *Capabilities) RequestedBestEffort(cb func(granted []cap.Value) error, values ...cap.Value) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if !managed {
+		return cb(values)
+	}
+	defer c.leave(&err)
+
+	granted := c.permitted(values...)
+
+	return c.Requested(func() error {
+		return cb(granted)
+	}, granted...)
+}
+
+// WithFeatureCaps registers the given capabilities for the feature, like
+// RequireForFeature() does, and runs the callback with them Effective, like
+// RequestedBestEffort() does: capabilities not permitted are neither registered
+// nor made Effective, and the callback is told which ones were granted.
+func (c *Capabilities) WithFeatureCaps(feature string, values []cap.Value, cb func(granted []cap.Value) error) (err error) {
+	var unregistered []cap.Value
+
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if !managed {
+		return cb(values)
+	}
+	defer c.leave(&err)
+
+	granted := c.permitted(values...)
+	for _, v := range granted {
+		if !c.neededBy(feature, v) {
+			unregistered = append(unregistered, v)
+		}
+	}
+	err = c.require(feature, unregistered...)
+	if err != nil {
+		return err
+	}
+
+	return c.Requested(func() error {
+		return cb(granted)
+	}, granted...)
+}
+
+// RequestedByName is like Requested() but capabilities are given by name.
+func (c *Capabilities) RequestedByName(cb func() error, names ...string) error {
+	values, err := ReqByString(names...)
+	if err != nil {
+		return err
+	}
+
+	return c.Requested(cb, values...)
+}
+
+// RequestedSet is like Requested() but capabilities are given by a previously
+// prepared capability set (see PrepareCapSet). A nil set is an error.
+func (c *Capabilities) RequestedSet(cb func() error, set *CapSet) error {
+	if set == nil {
+		return couldNotUseNilCapSet()
+	}
+
+	return c.Requested(cb, set.values...)
+}
+
+// RequestedOp is an operation of a RequestedBatch: a callback and the
+// capabilities it needs Effective.
+type RequestedOp struct {
+	Callback func() error
+	Values   []cap.Value
+}
+
+// RequestedBatch is like Requested() for several operations at once: the union
+// of their capabilities is made Effective once, the callbacks are run in order
+// (stopping at the first failing one), and capabilities are dropped once,
+// saving transitions (and syscalls) during startup. Callbacks share the same
+// Effective set: each one runs with the capabilities of the others, so only
+// batch operations that are safe to run together.
+func (c *Capabilities) RequestedBatch(ops []RequestedOp) error {
+	var values []cap.Value
+	for _, op := range ops {
+		values = append(values, op.Values...)
+	}
+
+	return c.Requested(func() error {
+		for _, op := range ops {
+			err := op.Callback()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}, dedupValues(values)...)
+}
+
+// EnterRequested is like Requested() but, instead of running a callback, it
+// returns once the ring is entered, along with the function leaving it, for
+// privileged regions spanning several functions:
+//
+//	restore, err := caps.EnterRequested(cap.NET_ADMIN)
+//	if err != nil {
+//		return err
+//	}
+//	defer restore()
+//
+// The capabilities lock is held until restore is called, from the same
+// goroutine: never calling it blocks every other ring forever (a warning is
+// logged if it is garbage collected before being called). Calling it again does
+// nothing. Confined Requested rings (see Confine) need a callback.
+func (c *Capabilities) EnterRequested(values ...cap.Value) (restore func() error, err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return nil, err
+	}
+	if !managed {
+		return func() error { return nil }, nil
+	}
+	defer func() {
+		if err != nil {
+			c.leave(&err) // back to the previous ring
+		}
+	}()
+
+	if c.lockedDown {
+		return nil, couldNotEnterLockedDown(Requested)
+	}
+	if len(c.confined[Requested]) > 0 {
+		return nil, couldNotEnterRequested(errors.New("the ring is confined, use Requested"))
+	}
+	err = c.checkPermitted(values...)
+	if err != nil {
+		return nil, err
+	}
+	err = c.set(Requested, values...)
+	if err != nil {
+		return nil, err
+	}
+	err = c.apply(Requested) // ring2 as effective
+	if err != nil {
+		return nil, err
+	}
+	err = c.unset(Requested, values...) // clean requested (for next calls)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scope{}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		s.caller = fmt.Sprintf("%s:%d", file, line)
+	}
+	runtime.SetFinalizer(s, func(s *scope) {
+		logger.Error("requested ring entered but never left, capabilities lock leaked", "pkg", pkgName, "caller", s.caller)
+	})
+
+	return func() (err error) {
+		if s.left {
+			return nil
+		}
+		s.left = true
+		runtime.SetFinalizer(s, nil)
+
+		c.leave(&err) // back to the previous ring
+		return err
+	}, nil
+}
+
+// DropTemporarily runs the callback without any Effective capabilities, like in
+// ring3, restoring the enclosing ring afterwards. It inverts the usual pattern:
+// called from a Privileged (or any other ring) callback, it keeps untrusted code
+// (plugins...) from using the capabilities of the enclosing ring. Capabilities
+// stay permitted: it is a defense in depth, not a sandbox. Nothing is dropped
+// when bypassing.
+func (c *Capabilities) DropTemporarily(cb func() error) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if managed {
+		defer c.leave(&err) // back to the enclosing ring
+
+		err = c.apply(Unprivileged) // ring3 as effective
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.run(Unprivileged, cb) // callback
+}
+
+// setters/getters
+
+// Require is called after initialization, configures all required capabilities,
+// and those required capabilities are set as Effective each time Required() is
+// called.
+func (c *Capabilities) Require(values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	return c.require("", values...)
+}
+
+// RequireForFeature requires the given capabilities, like Require() does, and
+// registers them as needed by the given feature.
+func (c *Capabilities) RequireForFeature(feature string, values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	return c.require(feature, values...)
+}
+
+// RequireForFeatureOnKernel is like RequireForFeature() but the capabilities are
+// only required if the running kernel is, at least, of the given version.
+func (c *Capabilities) RequireForFeatureOnKernel(feature string, minVersion string, values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	cmp, err := helpers.CompareKernelRelease(minVersion, c.release)
+	if err != nil {
+		return couldNotCompareKernel(err)
+	}
+	if cmp == helpers.KernelVersionOlder {
+		logger.Debug("kernel older than needed, not requiring", "pkg", pkgName,
+			"feature", feature, "kernel", c.release, "minVersion", minVersion, "caps", capNames(values))
+		return nil
+	}
+
+	err = c.require(feature, values...)
+	if err != nil {
+		return err
+	}
+	c.because(fmt.Sprintf("kernel: %v is %v or newer (feature: %v)", c.release, minVersion, feature), values...)
+
+	return nil
+}
+
+// Seal fixes the required ring: from now on, Require() and RequireForFeature()
+// fail if they would add capabilities to the required ring. It is meant to be
+// called once all features have registered their needs. Nothing is sealed if
+// not initialized.
+func (c *Capabilities) Seal() {
+	if !c.initialized() || c.bypass {
+		return
+	}
+
+	unlock := c.wlock()
+	c.sealed = true
+	unlock()
+}
+
+// ForFeature is a Requested ring whose Effective capabilities are exactly the
+// ones registered, with RequireForFeature(), for the given feature.
+func (c *Capabilities) ForFeature(feature string, cb func() error) (err error) {
+	managed, err := c.enter()
+	if err != nil {
+		return err
+	}
+	if !managed {
+		return cb()
+	}
+	defer c.leave(&err)
+
+	values, ok := c.features[feature]
+
+	if !ok {
+		return couldNotFindFeature(feature)
+	}
+
+	return c.Requested(cb, values...)
+}
+
+// CapExplanation tells why a capability is required.
+type CapExplanation struct {
+	Value     cap.Value  `json:"value"`
+	Name      string     `json:"name"`
+	Reasons   []string   `json:"reasons"`
+	Decisions []Decision `json:"decisions,omitempty"`
+}
+
+// Explain returns, for every required capability, the reasons why it is
+// required: initialization decisions, features requiring it, or a runtime
+// requirement (Require() called after initialization). Nothing is explained if
+// not initialized.
+func (c *Capabilities) Explain() []CapExplanation {
+	var explanations []CapExplanation
+
+	if !c.initialized() || c.bypass {
+		return nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	features := make([]string, 0, len(c.features))
+	for feature := range c.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	for _, v := range c.ring(Required) {
+		reasons := append([]string{}, c.reasons[v]...)
+		for _, feature := range features {
+			for _, value := range c.features[feature] {
+				if value == v {
+					reasons = append(reasons, "feature: "+feature)
+					break
+				}
+			}
+		}
+		if len(reasons) == 0 {
+			reasons = append(reasons, "runtime requirement")
+		}
+		var decisions []Decision
+		for _, d := range c.decisions {
+			for _, value := range d.Caps {
+				if value == v {
+					decisions = append(decisions, d)
+					break
+				}
+			}
+		}
+		explanations = append(explanations, CapExplanation{
+			Value:     v,
+			Name:      NameOf(v),
+			Reasons:   reasons,
+			Decisions: decisions,
+		})
+	}
+
+	return explanations
+}
+
+// SimulateDrop returns, sorted, the features that would break if the given
+// capability was dropped from the required ring. Nothing is actually dropped.
+// No feature is impacted if not initialized.
+func (c *Capabilities) SimulateDrop(v cap.Value) []string {
+	var impacted []string
+
+	if !c.initialized() || c.bypass {
+		return nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	for feature, values := range c.features {
+		for _, value := range values {
+			if value == v {
+				impacted = append(impacted, feature)
+				break
+			}
+		}
+	}
+	sort.Strings(impacted)
+
+	return impacted
+}
+
+// Unrequire releases capabilities required with Require(): required
+// capabilities are reference-counted, a capability being removed from the
+// required ring only once every Require() of it was released and no feature
+// needs it (see UnregisterRequirement). Use ForceUnrequire to remove them
+// regardless.
+func (c *Capabilities) Unrequire(values ...cap.Value) error {
+	var released []cap.Value
+
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	err := validValues(values...)
+	if err != nil {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	for _, v := range dedupValues(values) {
+		if c.direct[v] > 0 {
+			c.direct[v]--
+		}
+		if c.direct[v] > 0 || c.neededByFeature(v) {
+			continue // still required
+		}
+		delete(c.direct, v)
+		released = append(released, v)
+	}
+
+	return c.unrequire(released...)
+}
+
+// ForceUnrequire is only called when command line "capabilities drop=X" is
+// given. It works by removing, from the required ring, the capabilities given
+// by the user, whoever requires them. This way, when tracee shifts to ring1
+// (Required), that capability won't be Effective.
+func (c *Capabilities) ForceUnrequire(values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	err := c.unrequire(values...)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		delete(c.direct, v)
+	}
+
+	return nil
+}
+
+// SetAuditWriter sets a writer to which every ring transition, and every change
+// of the required ring, is written as a JSON line (independently of logging).
+// A nil writer disables the audit trail. It does nothing if not initialized.
+func (c *Capabilities) SetAuditWriter(w io.Writer) {
+	if !c.initialized() {
+		return
+	}
+
+	c.auditLock.Lock()
+	c.audit = w
+	c.auditLock.Unlock()
+}
+
+// Confine configures a ring to also clear the given capabilities from the
+// Permitted set while its callback runs, so not even a re-elevation within that
+// scope can make them Effective. The kernel never allows a capability cleared
+// from Permitted to be raised again, so confined callbacks are executed in a
+// disposable OS thread: the process Permitted set is never touched and is,
+// effectively, restored as soon as the callback returns (or panics).
+//
+// Being in another thread, a confined callback can't enter rings: Privileged,
+// Required, Requested (and alike) fail when called from it, instead of waiting
+// for the ring it runs in. Other methods can be called.
+//
+// NOTE: goroutines started by a confined callback do not inherit confinement.
+func (c *Capabilities) Confine(t Ring, values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	c.confined[t] = append(c.confined[t], values...)
+	unlock()
+
+	return nil
+}
+
+// Unconfine removes all Permitted restrictions previously set for a ring.
+func (c *Capabilities) Unconfine(t Ring) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	delete(c.confined, t)
+	unlock()
+
+	return nil
+}
+
+// AllPotentialCaps returns, sorted, all capabilities tracee might ever need: the
+// required ones, the ones registered for any feature and the ones any builtin
+// feature would need. None are returned if not initialized.
+func (c *Capabilities) AllPotentialCaps() []cap.Value {
+	if !c.initialized() || c.bypass {
+		return nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.allPotentialCaps()
+}
+
+func (c *Capabilities) allPotentialCaps() []cap.Value {
+	var values []cap.Value
+
+	potential := make(map[cap.Value]bool)
+	for _, v := range c.ring(Required) {
+		potential[v] = true
+	}
+	for _, feature := range c.features {
+		for _, v := range feature {
+			potential[v] = true
+		}
+	}
+	for _, feature := range []string{FeatureBPF, FeaturePerf} {
+		builtin, _ := builtinFeatureCaps(feature, c.hasBPF)
+		for _, v := range builtin {
+			potential[v] = true
+		}
+	}
+
+	for v := range potential {
+		values = append(values, v)
+	}
+	sortValues(values)
+
+	return values
+}
+
+// adviseExcessPermitted logs an advisory if the permitted set has capabilities
+// not in AllPotentialCaps.
+func (c *Capabilities) adviseExcessPermitted() {
+	var excess []cap.Value
+
+	potential := c.allPotentialCaps()
+	needed := make(map[cap.Value]bool)
+	for _, v := range potential {
+		needed[v] = true
+	}
+	for v := range c.all {
+		if permitted, _ := c.have.GetFlag(cap.Permitted, v); permitted && !needed[v] {
+			excess = append(excess, v)
+		}
+	}
+	if len(excess) == 0 {
+		return
+	}
+	sortValues(excess)
+
+	logger.Warn(fmt.Sprintf("tracee is running with more capabilities than it needs; consider narrowing the securityContext to %v", capNames(potential)),
+		"pkg", pkgName, "excess", capNames(excess))
+}
+
+// CanEnter tells whether all capabilities needed by the given ring are in the
+// permitted set, returning the missing ones otherwise. No ring can be entered
+// if not initialized.
+func (c *Capabilities) CanEnter(t Ring) (bool, []cap.Value) {
+	if !c.initialized() {
+		return false, nil
+	}
+
+	var missing []cap.Value
+
+	if c.bypass {
+		return true, nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	for _, v := range c.ring(t) {
+		permitted, err := c.have.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			missing = append(missing, v)
+		}
+	}
+
+	return len(missing) == 0, missing
+}
+
+// AssertRequiredEffective checks, without changing anything, that all required
+// capabilities are effective in the calling thread right now. It is meant to be
+// called from code already running in the required ring (within a Required()
+// callback, for example) before doing privileged work. It can be called from
+// within a ring callback.
+func (c *Capabilities) AssertRequiredEffective() error {
+	var missing []cap.Value
+
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	current := getThreadCaps()
+
+	for _, v := range c.ring(Required) {
+		effective, err := current.GetFlag(cap.Effective, v)
+		if err != nil || !effective {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return couldNotAssertEffective(missing)
+	}
+
+	return nil
+}
+
+// Validate fails fast, listing them, if required capabilities are not in the
+// permitted set: otherwise they would only surface later as cryptic errors
+// (loading eBPF objects...). It is meant to be called once all requirements,
+// and removals (see ForceUnrequire), are in place. Nothing is validated when
+// bypassing.
+func (c *Capabilities) Validate() error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.checkRequiredPermitted()
+}
+
+// TransitionTo makes the given ring effective, outside of ring callbacks, and
+// returns the transition made, with the capabilities raised and lowered, so it
+// can be recorded (security logs...). The ring stays effective until the next
+// ring callback returns (back to Unprivileged). Nothing changes, and an empty
+// transition is returned, when bypassing. It must not be called from a ring
+// callback.
+func (c *Capabilities) TransitionTo(t Ring) (RingEvent, error) {
+	if managed, err := c.guard(); !managed {
+		return RingEvent{}, err
+	}
+
+	if c.holding() {
+		return RingEvent{}, couldNotTransition(t, errors.New("called from a ring callback"))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lockedDown && (t == Privileged || t == Requested) {
+		return RingEvent{}, couldNotEnterLockedDown(t)
+	}
+	event, err := c.transition(t, func(v cap.Value) bool { return c.all[v][t] })
+	if err != nil {
+		return RingEvent{}, couldNotTransition(t, err)
+	}
+
+	return event, nil
+}
+
+// SetPrivilegedWatchdog makes Privileged ring callbacks running longer than the
+// given duration log a warning, with the stacks of all goroutines, surfacing
+// slow (or deadlocked) privileged paths. Callbacks are not interrupted: all
+// capabilities stay effective until they return. 0 disables the watchdog. It
+// does nothing if not initialized.
+func (c *Capabilities) SetPrivilegedWatchdog(d time.Duration) {
+	if !c.initialized() || c.bypass {
+		return
+	}
+
+	unlock := c.wlock()
+	defer unlock()
+
+	c.watchdog = d
+}
+
+// IsBypass tells whether capabilities are not managed (see Initialize): rings
+// then run their callbacks with the capabilities the process was started with.
+// It is false if not initialized.
+func (c *Capabilities) IsBypass() bool {
+	if !c.initialized() {
+		return false
+	}
+
+	return c.bypass
+}
+
+// EffectiveRing returns the ring currently effective (the last one applied).
+// When bypassing, nothing is ever dropped: Privileged is returned. Unprivileged
+// is returned if not initialized.
+func (c *Capabilities) EffectiveRing() Ring {
+	if !c.initialized() {
+		return Unprivileged
+	}
+
+	if c.bypass {
+		return Privileged
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.current
+}
+
+// ListRequired returns, sorted, the capabilities currently required (none if
+// not initialized).
+func (c *Capabilities) ListRequired() []cap.Value {
+	if !c.initialized() || c.bypass {
+		return nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.ring(Required)
+}
+
+// IsRequired tells whether the given capability is currently required (never
+// if not initialized).
+func (c *Capabilities) IsRequired(v cap.Value) bool {
+	if !c.initialized() || c.bypass {
+		return false
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.all[v][Required]
+}
+
+// ParanoidLevel returns the perf_event_paranoid level detected at initialization
+// (deciding whether cap.SYS_ADMIN is required), or UnknownParanoiaLevel if it
+// could not be read (the highest level being assumed) or was never read (not
+// initialized).
+func (c *Capabilities) ParanoidLevel() int {
+	if !c.initialized() || c.bypass {
+		return UnknownParanoiaLevel
+	}
+
+	return c.paranoid // only written during init
+}
+
+// GetEffective returns, sorted, the capabilities currently Effective.
+func (c *Capabilities) GetEffective() ([]cap.Value, error) {
+	return c.flagged(cap.Effective)
+}
+
+// GetPermitted returns, sorted, the capabilities currently Permitted.
+func (c *Capabilities) GetPermitted() ([]cap.Value, error) {
+	return c.flagged(cap.Permitted)
+}
+
+// HasEffective tells whether the given capability is currently Effective,
+// without changing rings. When bypassing, the process capabilities are read.
+func (c *Capabilities) HasEffective(v cap.Value) (bool, error) {
+	if !c.initialized() {
+		return false, couldNotUseUninitialized()
+	}
+
+	err := validValues(v)
+	if err != nil {
+		return false, err
+	}
+
+	if c.bypass {
+		have, err := c.proc().GetProc()
+		if err != nil {
+			return false, couldNotGetProc(err)
+		}
+		return have.GetFlag(cap.Effective, v)
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	return c.have.GetFlag(cap.Effective, v)
+}
+
+// flagged returns, sorted, the capabilities with the given flag set. When
+// bypassing, the process capabilities are read, as none are cached.
+func (c *Capabilities) flagged(flag cap.Flag) ([]cap.Value, error) {
+	if !c.initialized() {
+		return nil, couldNotUseUninitialized()
+	}
+
+	var values []cap.Value
+
+	if c.bypass {
+		have, err := c.proc().GetProc()
+		if err != nil {
+			return nil, couldNotGetProc(err)
+		}
+		for v := cap.Value(0); v < cap.MaxBits(); v++ {
+			if on, _ := have.GetFlag(flag, v); on {
+				values = append(values, v)
+			}
+		}
+		return values, nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	for v := range c.all {
+		on, err := c.have.GetFlag(flag, v)
+		if err != nil {
+			return nil, err
+		}
+		if on {
+			values = append(values, v)
+		}
+	}
+	sortValues(values)
+
+	return values, nil
+}
+
+// DetectDrift tells whether the Effective capabilities of the process differ
+// from the ones last applied, which happens when other code (a dependency using
+// libcap directly...) changes them behind the package's back. It is meant for
+// periodic health checks: drifted capabilities are logged. Nothing drifts when
+// bypassing, or in dry run, as nothing is applied.
+func (c *Capabilities) DetectDrift() (bool, error) {
+	if !c.initialized() {
+		return false, couldNotUseUninitialized()
+	}
+
+	if c.bypass || c.dryRun {
+		return false, nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	current, err := c.proc().GetProc()
+	if err != nil {
+		return false, couldNotGetProc(err)
+	}
+
+	var drifted []cap.Value
+	for v := range c.all {
+		applied, _ := c.have.GetFlag(cap.Effective, v)
+		effective, _ := current.GetFlag(cap.Effective, v)
+		if applied != effective {
+			drifted = append(drifted, v)
+		}
+	}
+	if len(drifted) == 0 {
+		return false, nil
+	}
+
+	sortValues(drifted)
+	logger.Warn("capabilities changed externally", "pkg", pkgName, "ring", c.current.String(), "caps", capNames(drifted))
+
+	return true, nil
+}
+
+// Info returns a description of the current capabilities configuration, empty
+// if not initialized.
+func (c *Capabilities) Info() Info {
+	if !c.initialized() {
+		return Info{}
+	}
+
+	if c.bypass {
+		return Info{Bypass: true, Degraded: c.degraded, Sandbox: c.sandbox, UserNamespace: c.userns, Decisions: c.InitDecisions()}
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	features := make(map[string][]cap.Value)
+	for feature, values := range c.features {
+		features[feature] = append([]cap.Value{}, values...)
+	}
+	empty, bound, _ := BoundingSetEmpty()
+
+	var securebits *Securebits
+	if sb, err := getSecurebits(); err == nil {
+		securebits = &sb
+	}
+	ambient, _ := ListAmbient()
+
+	return Info{
+		Sandbox:          c.sandbox,
+		UserNamespace:    c.userns,
+		Required:         c.ring(Required),
+		Features:         features,
+		Creep:            append([]Creep{}, c.creep...),
+		BoundingSetEmpty: empty,
+		Bound:            bound,
+		Decisions:        c.InitDecisions(),
+		PrivilegedBudget: c.privilegedBudget(),
+		Securebits:       securebits,
+		Phase:            c.phase,
+		Ambient:          ambient,
+	}
+}
+
+// InitDecisions returns the decision points of the initialization, in order,
+// describing how the capabilities configuration was derived (none if not
+// initialized).
+func (c *Capabilities) InitDecisions() []Decision {
+	if !c.initialized() {
+		return nil
+	}
+
+	if len(c.decisions) == 0 {
+		return nil
+	}
+
+	return append([]Decision{}, c.decisions...) // only written during init
+}
+
+// DumpState returns, as indented JSON meant to be attached to bug reports, the
+// rings each capability is in and whether it is permitted and effective, along
+// with the perf_event_paranoid value detected at initialization.
+func (c *Capabilities) DumpState() ([]byte, error) {
+	if !c.initialized() {
+		return nil, couldNotUseUninitialized()
+	}
+
+	dump := stateDump{Bypass: c.bypass, Paranoid: c.ParanoidLevel(), Caps: make(map[string]capState)}
+
+	if !c.bypass {
+		runlock := c.rlock()
+		for v, rings := range c.all {
+			permitted, _ := c.have.GetFlag(cap.Permitted, v)
+			effective, _ := c.have.GetFlag(cap.Effective, v)
+			dump.Caps[NameOf(v)] = capState{
+				Privileged:   rings[Privileged],
+				Required:     rings[Required],
+				Requested:    rings[Requested],
+				Unprivileged: rings[Unprivileged],
+				Permitted:    permitted,
+				Effective:    effective,
+			}
+		}
+		runlock()
+	}
+
+	data, err := json.MarshalIndent(dump, "", "  ") // map keys are sorted
+	if err != nil {
+		return nil, couldNotDumpState(err)
+	}
+
+	return data, nil
+}
+
+// DumpStateToFile writes the current capabilities state (see Info), as JSON, to
+// the given file, for offline analysis. The file is replaced atomically.
+func (c *Capabilities) DumpStateToFile(path string) error {
+	if !c.initialized() {
+		return couldNotUseUninitialized()
+	}
+
+	data, err := json.MarshalIndent(stateFile{
+		SchemaVersion: StateSchemaVersion,
+		Info:          c.Info(),
+	}, "", "  ")
+	if err != nil {
+		return couldNotDumpState(err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return couldNotDumpState(err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after the rename
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return couldNotDumpState(err)
+	}
+
+	return nil
+}
+
+// Private Methods
+
+// unrequire removes the given capabilities from the required ring.
+func (c *Capabilities) unrequire(values ...cap.Value) error {
+	removed := c.in(Required, values...)
+	err := c.unset(Required, values...) // unpopulate ring1 (Required)
+	if err != nil {
+		return err
+	}
+	c.writeAudit("unrequire", Required, "", nil, removed)
+
+	return nil
+}
+
+// watchPrivileged logs a warning, with the stacks of all goroutines, if not
+// stopped before the given duration.
+func watchPrivileged(d time.Duration) *time.Timer {
+	return time.AfterFunc(d, func() {
+		buf := make([]byte, 64*1024)
+		logger.Warn("privileged ring callback exceeded its watchdog, capabilities still effective", "pkg", pkgName,
+			"watchdog", d, "stack", string(buf[:runtime.Stack(buf, true)]))
+	})
+}
+
+// validValues checks that the given values are capabilities libcap knows of.
+// cap.MaxBits() is probed, from the running kernel, once libcap starts: it does
+// not grow while running, capabilities of newer kernels being out of range.
+func validValues(values ...cap.Value) error {
+	for _, v := range values {
+		if v >= cap.MaxBits() {
+			return couldNotUseValue(v)
+		}
+	}
+
+	return nil
+}
+
+// initialized tells whether the instance was initialized (bypassing or not).
+func (c *Capabilities) initialized() bool {
+	return c != nil && (c.bypass || c.lock != nil)
+}
+
+// run executes a ring callback, confining it if the ring requires so.
+func (c *Capabilities) run(t Ring, cb func() error) error {
+	if t == Privileged && c.watchdog > 0 && !c.bypass {
+		defer watchPrivileged(c.watchdog).Stop()
+	}
+
+	if c.bypass || len(c.confined[t]) == 0 {
+		return cb()
+	}
+
+	return runConfined(func() error {
+		// the launcher thread acts for the ring holder, blocked meanwhile
+		atomic.StoreInt32(&c.confinedTID, int32(syscall.Gettid()))
+		defer atomic.StoreInt32(&c.confinedTID, 0)
+
+		return cb()
+	}, c.confined[t]...)
+}
+
+func (c *Capabilities) getProc() error {
+	var err error
+	var have *cap.Set
+
+	for attempt := 0; ; attempt++ {
+		have, err = c.proc().GetProc()
+		if err == nil {
+			break
+		}
+		if !isTransient(err) || attempt >= c.opts.GetProcRetries {
+			return couldNotGetProc(err)
+		}
+		logger.Debug("could not get process capabilities, retrying", "pkg", pkgName, "attempt", attempt+1, "error", err)
+		time.Sleep(getProcRetryDelay)
+	}
+	c.have = have
+
+	return nil
+}
+
+// refresh reads the process capabilities again if the cached ones can't be
+// trusted anymore.
+func (c *Capabilities) refresh() error {
+	if c.have != nil && !c.stale {
+		return nil
+	}
+
+	err := c.getProc()
+	if err != nil {
+		return err
+	}
+	c.stale = false
+
+	return nil
+}
+
+func (c *Capabilities) setProc() error {
+	if c.dryRun {
+		if !c.opts.quiet {
+			logger.Info("dry run, not setting capabilities", "pkg", pkgName, "effective", capNames(stateOf(c.have).Effective))
+		}
+		return nil
+	}
+
+	delay := setProcRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := c.proc().SetProc(c.have)
+		if err == nil {
+			break
+		}
+		if !isTransient(err) || attempt >= c.opts.SetProcRetries {
+			c.stale = true // might have been changed externally
+			return couldNotSetProc(err)
+		}
+		logger.Debug("could not set process capabilities, retrying", "pkg", pkgName, "attempt", attempt+1, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+	c.counters.setProcs++
+
+	if c.onSetProc != nil {
+		c.onSetProc(stateOf(c.have))
+	}
+
+	return nil
+}
+
+func (c *Capabilities) set(t Ring, values ...cap.Value) error {
+	err := validValues(values...)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if c.unsupported[v] {
+			return couldNotFindCapability(NameOf(v))
+		}
+	}
+	for _, v := range values {
+		if c.all[v] == nil {
+			c.all[v] = make(map[Ring]bool) // known to libcap, but not when initialized
+		}
+		c.all[v][t] = true
+	}
+
+	return nil
+}
+
+func (c *Capabilities) unset(t Ring, values ...cap.Value) error {
+	err := validValues(values...)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		if c.unsupported[v] {
+			continue
+		}
+		if c.all[v] == nil {
+			c.all[v] = make(map[Ring]bool) // known to libcap, but not when initialized
+		}
+		c.all[v][t] = false
+	}
+
+	return nil
+}
+
+// reconcile removes, from all rings, the capabilities not supported by the
+// running kernel, so libcap and kernel versions skew (cap.MaxBits() reporting
+// more capabilities than the kernel knows) can't make apply() change flags of
+// unknown capabilities.
+func (c *Capabilities) reconcile() {
+	var unsupported []cap.Value
+
+	for v := range c.all {
+		_, errFlag := c.have.GetFlag(cap.Permitted, v)
+		_, errBound := c.proc().GetBound(v)
+		if errFlag != nil || errBound != nil {
+			unsupported = append(unsupported, v)
+		}
+	}
+	if len(unsupported) == 0 {
+		return
+	}
+
+	c.unsupported = make(map[cap.Value]bool)
+	for _, v := range unsupported {
+		c.unsupported[v] = true
+		delete(c.all, v)
+	}
+	sortValues(unsupported)
+	logger.Warn("capabilities not supported by the kernel, ignoring them", "pkg", pkgName,
+		"caps", capNames(unsupported), "maxBits", int(cap.MaxBits()))
+}
+
+// ring returns, sorted, the capabilities set in the given ring.
+func (c *Capabilities) ring(t Ring) []cap.Value {
+	var values []cap.Value
+
+	for v, rings := range c.all {
+		if rings[t] {
+			values = append(values, v)
+		}
+	}
+	sortValues(values)
+
+	return values
+}
+
+// detectCreep records, and warns about, capabilities about to be required that
+// were not required at the end of initialization.
+func (c *Capabilities) detectCreep(values ...cap.Value) {
+	var added []cap.Value
+
+	for _, v := range values {
+		if !c.baseline[v] && !c.all[v][Required] {
+			added = append(added, v)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+
+	creep := Creep{Values: added}
+	if c.opts.CaptureStack {
+		buf := make([]byte, 4096)
+		creep.Caller = string(buf[:runtime.Stack(buf, false)])
+	} else if _, file, line, ok := runtime.Caller(3); ok {
+		creep.Caller = fmt.Sprintf("%s:%d", file, line)
+	}
+	c.creep = append(c.creep, creep)
+
+	logger.Warn("capability creep detected", "pkg", pkgName, "caps", added, "caller", creep.Caller)
+}
+
+// requireForParanoid requires cap.SYS_ADMIN for perf events if the given
+// perf_event_paranoid value is above the configured threshold.
+func (c *Capabilities) requireForParanoid(paranoid int) error {
+	threshold := c.opts.ParanoidThreshold
+	inputs := map[string]string{
+		"paranoid":  strconv.Itoa(paranoid),
+		"threshold": strconv.Itoa(threshold),
+	}
+
+	if _, perf := c.features[FeaturePerf]; !perf {
+		c.decide("paranoid", "perf feature disabled, ignored", inputs)
+		return nil // perf_event_paranoid only matters to perf
+	}
+
+	escalate := paranoid > threshold
+	logger.Debug("paranoid: comparing perf_event_paranoid to threshold", "pkg", pkgName,
+		"paranoid", paranoid, "threshold", threshold, "requireSysAdmin", escalate)
+	if !escalate {
+		c.decide("paranoid", fmt.Sprintf("paranoid=%v <= threshold=%v, no additional capabilities", paranoid, threshold), inputs)
+		return nil
+	}
+	c.decide("paranoid", fmt.Sprintf("paranoid=%v > threshold=%v, require cap_sys_admin", paranoid, threshold), inputs, cap.SYS_ADMIN)
+
+	logger.Debug("paranoid: Tracee needs CAP_SYS_ADMIN instead of CAP_BPF + CAP_PERFMON", "pkg", pkgName)
+	logger.Debug(fmt.Sprintf("paranoid: To change that behavior set perf_event_paranoid to %v or less.", threshold), "pkg", pkgName)
+
+	unlock := c.wlock()
+	defer unlock()
+
+	err := c.require(FeaturePerf, cap.SYS_ADMIN)
+	if err != nil {
+		return err
+	}
+	c.because(fmt.Sprintf("paranoid: perf_event_paranoid is %v (> %v)", paranoid, threshold), cap.SYS_ADMIN)
+
+	return nil
+}
+
+// verifyAllThreads checks that all threads of the process have the Effective
+// capabilities of the last applied ring.
+func (c *Capabilities) verifyAllThreads() error {
+	var expected uint64
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		if on, _ := c.have.GetFlag(cap.Effective, v); on {
+			expected |= 1 << uint(v)
+		}
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return couldNotVerifyThreads(err)
+	}
+
+	for _, task := range tasks {
+		effective, err := readStatusCaps(filepath.Join("/proc/self/task", task.Name(), "status"), "CapEff")
+		if errors.Is(err, os.ErrNotExist) {
+			continue // thread is gone
+		}
+		if err != nil {
+			return couldNotVerifyThreads(err)
+		}
+		if effective != expected {
+			return couldNotVerifyThreads(fmt.Errorf("thread %v has effective %016x, expected %016x", task.Name(), effective, expected))
+		}
+	}
+
+	return nil
+}
+
+// require populates ring1 (Required), registering the capabilities for the given
+// feature (if any).
+func (c *Capabilities) require(feature string, values ...cap.Value) error {
+	added := c.notIn(Required, values...)
+	if c.sealed && len(added) > 0 {
+		return couldNotRequireSealed(added)
+	}
+
+	if c.opts.DetectCreep && c.baseline != nil {
+		c.detectCreep(values...)
+	}
+
+	err := c.set(Required, values...)
+	if err != nil {
+		return err
+	}
+
+	if feature != "" {
+		c.features[feature] = append(c.features[feature], values...)
+	} else {
+		if c.direct == nil {
+			c.direct = make(map[cap.Value]int)
+		}
+		for _, v := range dedupValues(values) {
+			c.direct[v]++
+		}
+	}
+	c.writeAudit("require", Required, feature, added, nil)
+
+	return nil
+}
+
+// checkPermitted fails, naming them, if some of the given capabilities are not
+// permitted: making them Effective would fail with an opaque error.
+func (c *Capabilities) checkPermitted(values ...cap.Value) error {
+	err := c.refresh()
+	if err != nil {
+		return err
+	}
+
+	var missing []cap.Value
+	for _, v := range values {
+		permitted, err := c.have.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return couldNotRequestNotPermitted(missing)
+	}
+
+	return nil
+}
+
+// permitted returns the given capabilities that are permitted, logging the
+// ones that are not.
+func (c *Capabilities) permitted(values ...cap.Value) []cap.Value {
+	var granted, skipped []cap.Value
+
+	for _, v := range values {
+		permitted, err := c.have.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			skipped = append(skipped, v)
+			continue
+		}
+		granted = append(granted, v)
+	}
+	if len(skipped) > 0 {
+		logger.Debug("skipping requested capabilities not permitted", "pkg", pkgName, "caps", capNames(skipped))
+	}
+
+	return granted
+}
+
+// neededBy tells whether the given feature needs the given capability.
+func (c *Capabilities) neededBy(feature string, v cap.Value) bool {
+	for _, value := range c.features[feature] {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// guard fails if the instance is not initialized and tells whether it manages
+// capabilities: it does not when bypassing, leaving them as they are.
+func (c *Capabilities) guard() (managed bool, err error) {
+	if !c.initialized() {
+		return false, couldNotUseUninitialized()
+	}
+
+	return !c.bypass, nil
+}
+
+// enter enters a ring, if capabilities are managed (see guard): the goroutine
+// is locked to its OS thread, the lock is acquired unless that thread holds it
+// already (a ring called from within a ring callback), and the effective ring
+// is remembered so leave() can restore it. The rings entered (frames) are the
+// nesting depth: the lock is released once the outermost ring is left. Rings
+// must only be left (see leave) if managed.
+//
+// NOTE: callbacks of confined rings run in another thread, rings can't be
+// nested within them (see Confine).
+func (c *Capabilities) enter() (managed bool, err error) {
+	managed, err = c.guard()
+	if !managed {
+		return false, err
+	}
+
+	if c.inConfined() {
+		return false, couldNotEnterConfined()
+	}
+
+	// libcap changes the capabilities of all threads, but the calling thread
+	// is the one read back (and the one confined rings are launched from):
+	// keep the goroutine on it until the ring is left. No other goroutine runs
+	// on it meanwhile, so it also identifies the lock holder.
+	runtime.LockOSThread()
+
+	if !c.holding() {
+		err = c.elevate()
+		if err != nil {
+			runtime.UnlockOSThread()
+			return false, err
+		}
+		atomic.StoreInt32(&c.owner, int32(syscall.Gettid()))
+	}
+
+	effective := make(map[cap.Value]bool)
+	for v := range c.all {
+		if on, _ := c.have.GetFlag(cap.Effective, v); on {
+			effective[v] = true
+		}
+	}
+	c.frames = append(c.frames, frame{ring: c.current, effective: effective})
+
+	return true, nil
+}
+
+// holding tells whether the calling goroutine holds the lock: it entered a ring
+// and is, so, running a ring callback (locked to the thread holding the lock),
+// or it runs a confined callback for the holder.
+func (c *Capabilities) holding() bool {
+	return atomic.LoadInt32(&c.owner) == int32(syscall.Gettid()) || c.inConfined()
+}
+
+// inConfined tells whether the calling goroutine runs a confined callback (see
+// Confine), on behalf of the lock holder.
+func (c *Capabilities) inConfined() bool {
+	return atomic.LoadInt32(&c.confinedTID) == int32(syscall.Gettid())
+}
+
+// rlock read locks the capabilities, unless the calling goroutine already holds
+// the lock (called from within a ring callback), and returns the function
+// releasing them.
+func (c *Capabilities) rlock() (runlock func()) {
+	if c.holding() {
+		return func() {} // called from within a ring callback
+	}
+
+	c.lock.RLock()
+
+	return c.lock.RUnlock
+}
+
+// wlock locks the capabilities, unless the calling goroutine already holds the
+// lock (called from within a ring callback), and returns the function releasing
+// them.
+func (c *Capabilities) wlock() (unlock func()) {
+	if c.holding() {
+		return func() {} // called from within a ring callback
+	}
+
+	c.lock.Lock()
+
+	return c.lock.Unlock
+}
+
+// leave leaves the innermost ring: nested rings restore the effective set they
+// were entered with, the outermost ring goes back to ring3 and releases the
+// lock. An error restoring the ring is stored in the given error if it has
+// none. It is deferred by the rings, so the previous ring is also restored (and
+// the lock released) when a callback panics, before the panic propagates.
+func (c *Capabilities) leave(err *error) {
+	var errRestore error
+
+	f := c.frames[len(c.frames)-1]
+	c.frames = c.frames[:len(c.frames)-1]
+
+	if len(c.frames) == 0 {
+		if f.changed {
+			errRestore = c.apply(Unprivileged) // back to ring3
+		}
+		atomic.StoreInt32(&c.owner, 0)
+		c.lock.Unlock()
+	} else if f.changed {
+		errRestore = c.applyEffective(f.ring, func(v cap.Value) bool { return f.effective[v] })
+	}
+
+	runtime.UnlockOSThread()
+
+	if *err == nil {
+		*err = errRestore
+	}
+}
+
+// bpfSupport tells whether the running kernel supports cap.BPF (and
+// cap.PERFMON), and why: it is v5.8 or newer, or cap.BPF was backported (the
+// kernel knows it, see reconcile).
+func (c *Capabilities) bpfSupport() (bool, string) {
+	return kernelBPFSupport(c.release, c.all[cap.BPF] != nil)
+}
+
+// kernelBPFSupport tells whether the given kernel release supports cap.BPF,
+// and how: v5.8 or newer, or backported (the kernel knows the capability).
+func kernelBPFSupport(release string, known bool) (bool, string) {
+	cmp, err := helpers.CompareKernelRelease("5.8", release)
+	if err == nil && cmp != helpers.KernelVersionOlder {
+		return true, "v5.8 or newer"
+	}
+	if known {
+		return true, "backported"
+	}
+
+	return false, "none"
+}
+
+// checkRequiredPermitted fails, listing them, if required capabilities are not
+// in the permitted set.
+func (c *Capabilities) checkRequiredPermitted() error {
+	var missing []cap.Value
+
+	for _, v := range c.ring(Required) {
+		permitted, err := c.have.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		return couldNotPermitRequired(missing)
+	}
+
+	return nil
+}
+
+// elevate acquires the lock to enter an elevated ring, failing fast if too many
+// callers are already waiting for it.
+func (c *Capabilities) elevate() error {
+	if max := c.opts.MaxQueuedElevations; max > 0 {
+		if atomic.AddInt32(&c.waiting, 1) > int32(max) {
+			atomic.AddInt32(&c.waiting, -1)
+			return ErrTooManyElevations
+		}
+		defer atomic.AddInt32(&c.waiting, -1)
+	}
+
+	c.lock.Lock()
+
+	return nil
+}
+
+// privilegedBudget returns the remaining Privileged ring time budget, or nil
+// if there is no budget.
+func (c *Capabilities) privilegedBudget() *time.Duration {
+	if c.opts.PrivilegedTimeBudget <= 0 {
+		return nil
+	}
+
+	remaining := c.opts.PrivilegedTimeBudget - c.counters.timeInRing[Privileged]
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return &remaining
+}
+
+// checkPrivilegedBudget logs, or fails, if the Privileged ring time budget is
+// spent.
+func (c *Capabilities) checkPrivilegedBudget() error {
+	remaining := c.privilegedBudget()
+	if remaining == nil || *remaining > 0 {
+		return nil
+	}
+
+	if c.opts.PrivilegedBudgetFail {
+		return ErrPrivilegedBudgetExceeded
+	}
+	logger.Error("privileged time budget exceeded", "pkg", pkgName,
+		"budget", c.opts.PrivilegedTimeBudget, "spent", c.counters.timeInRing[Privileged])
+
+	return nil
+}
+
+// decide records a decision point of the initialization.
+func (c *Capabilities) decide(point string, outcome string, inputs map[string]string, values ...cap.Value) {
+	c.decisions = append(c.decisions, Decision{
+		Point:   point,
+		Inputs:  inputs,
+		Outcome: outcome,
+		Caps:    values,
+	})
+}
+
+// because records a reason for the given capabilities to be required.
+func (c *Capabilities) because(reason string, values ...cap.Value) {
+	for _, v := range values {
+		c.reasons[v] = append(c.reasons[v], reason)
+	}
+}
+
+// in returns the given capabilities that are set in the given ring.
+func (c *Capabilities) in(t Ring, values ...cap.Value) []cap.Value {
+	var found []cap.Value
+
+	for _, v := range values {
+		if c.all[v][t] {
+			found = append(found, v)
+		}
+	}
+
+	return found
+}
+
+// notIn returns the given capabilities that are not set in the given ring.
+func (c *Capabilities) notIn(t Ring, values ...cap.Value) []cap.Value {
+	var found []cap.Value
+
+	for _, v := range values {
+		if !c.all[v][t] {
+			found = append(found, v)
+		}
+	}
+
+	return found
+}
+
+// auditEntry is a line of the audit trail (see SetAuditWriter).
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Ring      string    `json:"ring"`
+	Feature   string    `json:"feature,omitempty"`
+	Raised    []string  `json:"raised,omitempty"`
+	Lowered   []string  `json:"lowered,omitempty"`
+}
+
+// writeAudit writes an entry to the audit trail, if there is one.
+func (c *Capabilities) writeAudit(op string, t Ring, feature string, raised, lowered []cap.Value) {
+	c.auditLock.Lock()
+	defer c.auditLock.Unlock()
+
+	if c.audit == nil {
+		return
+	}
+
+	entry, err := json.Marshal(auditEntry{
+		Time:      time.Now().UTC(),
+		Operation: op,
+		Ring:      t.String(),
+		Feature:   feature,
+		Raised:    capNames(raised),
+		Lowered:   capNames(lowered),
+	})
+	if err == nil {
+		_, err = c.audit.Write(append(entry, '\n'))
+	}
+	if err != nil {
+		logger.Error("could not write capabilities audit", "pkg", pkgName, "error", err)
+	}
+}
+
+func (c *Capabilities) apply(t Ring) error {
+	return c.applyEffective(t, func(v cap.Value) bool { return c.all[v][t] })
+}
+
+// setEffective sets, in the cached capabilities, the Effective flag of the
+// capabilities for which the given function returns true. Only the flags that
+// change are set, and the capabilities raised and lowered are returned.
+func (c *Capabilities) setEffective(effective func(cap.Value) bool) ([]cap.Value, []cap.Value, error) {
+	var raised, lowered []cap.Value
+
+	for k := range c.all {
+		on := effective(k)
+		was, _ := c.have.GetFlag(cap.Effective, k)
+		switch {
+		case on && !was:
+			logger.Debug("enabling", "pkg", pkgName, "cap", k)
+			raised = append(raised, k)
+		case !on && was:
+			logger.Debug("disabling", "pkg", pkgName, "cap", k)
+			lowered = append(lowered, k)
+		}
+	}
+
+	// flags are changed in batches, not one capability at a time
+
+	err := c.have.SetFlag(cap.Effective, true, raised...)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = c.have.SetFlag(cap.Effective, false, lowered...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return raised, lowered, nil
+}
+
+// applyEffective makes effective the capabilities for which the given function
+// returns true, accounting the change as a transition to the given ring.
+func (c *Capabilities) applyEffective(t Ring, effective func(cap.Value) bool) error {
+	_, err := c.transition(t, effective)
+	return err
+}
+
+// transition is applyEffective, returning the transition made.
+func (c *Capabilities) transition(t Ring, effective func(cap.Value) bool) (event RingEvent, err error) {
+	var raised, lowered []cap.Value
+
+	c.seq++ // correlates the logs of a transition, even if timestamps collide
+	logger.Debug("capabilities change", "pkg", pkgName, "seq", c.seq, "from", c.current.String(), "to", t.String())
+
+	if hook := c.ringHook; hook != nil {
+		from := c.current
+		hook(from, t)
+		defer hook(from, t) // whether the change failed or not
+	}
+
+	// The cached capabilities are trusted, avoiding a syscall per transition,
+	// unless changing them fails: they might have been changed externally, so
+	// they are read again and the change retried once.
+
+	for attempt := 0; ; attempt++ {
+		err = c.refresh()
+		if err != nil {
+			return RingEvent{}, err
+		}
+		raised, lowered, err = c.setEffective(effective)
+		if err != nil {
+			return RingEvent{}, err
+		}
+		err = c.setProc()
+		if err == nil {
+			break
+		}
+		if attempt > 0 {
+			return RingEvent{}, err
+		}
+		logger.Debug("could not change capabilities, reading them again", "pkg", pkgName, "error", err)
+	}
+	if len(c.frames) > 0 {
+		c.frames[len(c.frames)-1].changed = true
+	}
+	if c.opts.DebugVerifyThreads && !c.dryRun {
+		err = c.verifyAllThreads()
+		if err != nil {
+			return RingEvent{}, err
+		}
+	}
+
+	sortValues(raised)
+	sortValues(lowered)
+	event = RingEvent{
+		From:    c.current,
+		To:      t,
+		Raised:  raised,
+		Lowered: lowered,
+		Time:    time.Now(),
+	}
+	c.publish(event)
+	c.current = t
+	c.countTransition(t, raised)
+	c.writeAudit("transition", t, "", raised, lowered)
+
+	return event, nil
+}
+
+//
+// Error Functions
+//
+
+func couldNotFindCapability(cap string) error {
+	return fmt.Errorf("could not find capability: %v", cap)
+}
+
+func couldNotFindCapabilities(names []string) error {
+	return fmt.Errorf("could not find capabilities: %v", strings.Join(names, ", "))
+}
+
+func couldNotUseValue(v cap.Value) error {
+	return fmt.Errorf("could not use capability value %d: out of range [0, %d)", int(v), int(cap.MaxBits()))
+}
+
+func couldNotFindFeature(feature string) error {
+	return fmt.Errorf("could not find feature: %v", feature)
+}
+
+func couldNotGetBound(e error) error {
+	return fmt.Errorf("could not get bounding set: %w", e)
+}
+
+func couldNotDropBound(v cap.Value, e error) error {
+	return fmt.Errorf("could not drop %v from bounding set: %w", v, e)
+}
+
+func couldNotVerifyThreads(e error) error {
+	return fmt.Errorf("could not verify capabilities of all threads: %w", e)
+}
+
+func couldNotAssertEffective(values []cap.Value) error {
+	return fmt.Errorf("could not assert required capabilities: %v not effective", capNames(values))
+}
+
+func couldNotEnterLockedDown(t Ring) error {
+	return fmt.Errorf("could not enter %v ring: %w", t, ErrLockedDown)
+}
+
+func couldNotRequireSealed(values []cap.Value) error {
+	return fmt.Errorf("could not require capabilities %v: required capabilities are sealed", capNames(values))
+}
+
+func couldNotCompareKernel(e error) error {
+	return fmt.Errorf("could not compare kernel versions: %w", e)
+}
+
+func couldNotProbeBPFCaps(e error) error {
+	return fmt.Errorf("could not probe bpf capabilities: %w", e)
+}
+
+func couldNotSnapshot(e error) error {
+	return fmt.Errorf("could not snapshot capabilities: %w", e)
+}
+
+func couldNotDiffFromParent(e error) error {
+	return fmt.Errorf("could not diff capabilities from parent: %w", e)
+}
+
+func couldNotDumpState(e error) error {
+	return fmt.Errorf("could not dump capabilities state: %w", e)
+}
+
+func couldNotUseParanoidThreshold(threshold int) error {
+	return fmt.Errorf("could not use perf_event_paranoid threshold %v: must be between %v and %v", threshold, MinParanoiaLevel, MaxParanoiaLevel)
+}
+
+func couldNotUseMaxQueuedElevations(max int) error {
+	return fmt.Errorf("could not use maximum queued elevations %v: must not be negative", max)
+}
+
+func couldNotReadPerfEventParanoid() error {
+	return fmt.Errorf("could not read procfs perf_event_paranoid")
+}
+
+func couldNotRequestNotPermitted(values []cap.Value) error {
+	return fmt.Errorf("could not request capabilities: %v not permitted to this process", strings.Join(capNames(values), ", "))
+}
 
-const (
-	Privileged   ringType = iota // ring0 (all capabilities enabled, startup/shutdown)
-	Required                     // ring1 (needed capabilities only: config time)
-	Requested                    // ring2 (temporary specific capabilities)
-	Unprivileged                 // ring3 (no capabilities: runtime)
-)
+func couldNotEnterRequested(e error) error {
+	return fmt.Errorf("could not enter requested ring: %w", e)
+}
 
-type Capabilities struct {
-	have   *cap.Set
-	all    map[cap.Value]map[ringType]bool
-	bypass bool
-	lock   *sync.Mutex // big lock to guarantee all threads are on the same ring
+func couldNotTransition(t Ring, e error) error {
+	return fmt.Errorf("could not transition to %v ring: %w", t, e)
 }
 
-// Initialize initializes the "caps" instance (singleton).
-func Initialize(bypass bool) error {
-	var err error
+func couldNotUseUninitialized() error {
+	return fmt.Errorf("could not use capabilities: %w", ErrNotInitialized)
+}
 
-	once.Do(func() {
-		caps = &Capabilities{}
-		err = caps.initialize(bypass)
-	})
+func couldNotPermitRequired(values []cap.Value) error {
+	return fmt.Errorf("%w: %v (run with more privileges, or unrequire them)", ErrRequiredNotPermitted, capNames(values))
+}
 
-	return err
+func couldNotSetProc(e error) error {
+	return &SetProcError{Err: e}
 }
 
-// GetInstance returns current "caps" instance. It initializes capabilities if
-// needed, bypassing the privilege dropping by default.
-func GetInstance() *Capabilities {
-	if caps == nil {
-		err := Initialize(true)
-		if err != nil {
-			return nil
-		}
+func couldNotGetProc(e error) error {
+	return fmt.Errorf("could not get capabilities: %w", e)
+}
 
-	}
-	return caps
+func couldNotConfine(e error) error {
+	return fmt.Errorf("could not confine capabilities: %w", e)
 }
 
-func (c *Capabilities) initialize(bypass bool) error {
-	if bypass {
-		c.bypass = true
-		return nil
-	}
+func couldNotRestore(e error) error {
+	return fmt.Errorf("could not restore capabilities: %w", e)
+}
 
-	c.lock = new(sync.Mutex)
-	c.all = make(map[cap.Value]map[ringType]bool)
+func couldNotEnterConfined() error {
+	return errors.New("could not enter ring: called from a confined callback")
+}
 
-	for v := cap.Value(0); v < cap.MaxBits(); v++ {
-		c.all[v] = make(map[ringType]bool)
-		c.all[v][Privileged] = true // all capabilities are enabled
-		// Required, Requested and Unprivileged is false by default
-	}
+func couldNotUseNilCapSet() error {
+	return errors.New("could not use nil capability set")
+}
 
-	err := c.getProc()
-	if err != nil {
-		return err
-	}
+//
+// Standalone Functions
+//
 
-	for c := range c.all {
-		cap.DropBound(c) // drop all capabilities from bound
-	}
+// CapSet is an immutable set of resolved capabilities, safe for concurrent use,
+// meant to be reused by hot paths (see RequestedSet).
+type CapSet struct {
+	values []cap.Value
+}
 
-	err = c.setProc()
+// PrepareCapSet resolves, and validates, the given capability names once.
+func PrepareCapSet(names ...string) (*CapSet, error) {
+	values, err := ReqByString(names...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// The base for required capabilities (ring1) depends on the following:
+	return &CapSet{values: values}, nil
+}
 
-	c.Require(
-		cap.IPC_LOCK,
-		cap.SYS_RESOURCE,
-	)
+// Values returns the capabilities of the set.
+func (s *CapSet) Values() []cap.Value {
+	return append([]cap.Value{}, s.values...)
+}
 
-	// Kernels bellow v5.8 do not support cap.BPF + cap.PERFMON (instead of
-	// having to have cap.SYS_ADMIN), nevertheless, some kernels, like RHEL8
-	// clones, have backported cap.BPF capability and might be able to use it.
+// ReqByString returns the capabilities with the given names, or in the groups
+// with the given "group:" prefixed names (see Groups). Capabilities names are
+// case insensitive and their "cap_" prefix is optional: cap_sys_admin,
+// CAP_SYS_ADMIN and sys_admin are the same. Groups have their own namespace, as
+// their names may be capabilities names too: bpf is cap_bpf, group:bpf is
+// cap_bpf and cap_perfmon. All unknown names are reported at once.
+func ReqByString(values ...string) ([]cap.Value, error) {
+	var capsToActOn []cap.Value
+	var unknown []string
 
-	paranoid, err := getKernelPerfEventParanoidValue()
-	if err != nil {
-		logger.Debug("could not get perf_event_paranoid, assuming highest", "pkg", pkgName)
+	for _, given := range values {
+		name := strings.ToLower(given)
+		if strings.HasPrefix(name, groupPrefix) {
+			group, ok := Groups[strings.TrimPrefix(name, groupPrefix)]
+			if !ok {
+				unknown = append(unknown, given)
+				continue
+			}
+			capsToActOn = append(capsToActOn, group...)
+			continue
+		}
+		v, ok := ValueOf(name)
+		if !ok {
+			unknown = append(unknown, given)
+			continue
+		}
+		capsToActOn = append(capsToActOn, v)
 	}
-
-	if paranoid > 2 {
-		logger.Debug("paranoid: Value in /proc/sys/kernel/perf_event_paranoid is > 2", "pkg", pkgName)
-		logger.Debug("paranoid: Tracee needs CAP_SYS_ADMIN instead of CAP_BPF + CAP_PERFMON", "pkg", pkgName)
-		logger.Debug("paranoid: To change that behavior set perf_event_paranoid to 2 or less.", "pkg", pkgName)
-		c.Require(cap.SYS_ADMIN)
+	switch len(unknown) {
+	case 0:
+	case 1:
+		return nil, couldNotFindCapability(unknown[0])
+	default:
+		return nil, couldNotFindCapabilities(unknown)
 	}
 
-	hasBPF, _ := c.have.GetFlag(cap.Permitted, cap.BPF)
-	if hasBPF {
-		c.Require(
-			cap.BPF,
-			cap.PERFMON,
-		)
-	} else {
-		c.Require(
-			cap.SYS_ADMIN,
-		)
+	for _, v := range capsToActOn {
+		warnDeprecated(v)
 	}
 
-	return c.apply(Unprivileged) // ring3 as effective
+	return capsToActOn, nil
 }
 
-// Public Methods
+var deprecatedOnce sync.Map // *sync.Once by capability, as names are also parsed on hot paths
 
-// Privileged is a protection ring with all caps set as Effective.
-func (c *Capabilities) Privileged(cb func() error) error {
-	var err error
+// warnDeprecated warns, once, if the given capability has narrower
+// replacements in the running kernel (see DeprecationInfo).
+func warnDeprecated(v cap.Value) {
+	once, _ := deprecatedOnce.LoadOrStore(v, &sync.Once{})
+	once.(*sync.Once).Do(func() {
+		if replacement, note, ok := DeprecationInfo(v); ok {
+			logger.Warn("capability has narrower replacements", "pkg", pkgName,
+				"cap", NameOf(v), "replacements", capNames(replacement), "note", note)
+		}
+	})
+}
 
-	if !c.bypass {
-		c.lock.Lock()
-		defer c.lock.Unlock()
+// deprecation describes capabilities carved out of a broader capability.
+type deprecation struct {
+	value       cap.Value
+	since       string // kernel version
+	replacement []cap.Value
+	note        string
+}
 
-		err = c.apply(Privileged) // ring0 as effective for callback exec
-		if err != nil {
-			return err
-		}
+// deprecations is the reference table of over-broad capabilities, ordered by
+// kernel version.
+var deprecations = []deprecation{
+	{
+		value:       cap.SYS_ADMIN,
+		since:       "2.6.37",
+		replacement: []cap.Value{cap.SYSLOG},
+		note:        "CAP_SYSLOG was carved out of CAP_SYS_ADMIN in v2.6.37 (kernel logs and symbols)",
+	},
+	{
+		value:       cap.SYS_ADMIN,
+		since:       "5.8",
+		replacement: []cap.Value{cap.BPF, cap.PERFMON},
+		note:        "CAP_BPF and CAP_PERFMON were carved out of CAP_SYS_ADMIN in v5.8 (eBPF and perf events)",
+	},
+	{
+		value:       cap.SYS_ADMIN,
+		since:       "5.9",
+		replacement: []cap.Value{cap.CHECKPOINT_RESTORE},
+		note:        "CAP_CHECKPOINT_RESTORE was carved out of CAP_SYS_ADMIN in v5.9",
+	},
+}
+
+// DeprecationInfo returns the narrower capabilities, available in the running
+// kernel, that should be preferred to the given over-broad capability.
+func DeprecationInfo(v cap.Value) (replacement []cap.Value, note string, ok bool) {
+	release, err := kernelRelease()
+	if err != nil {
+		return nil, "", false
 	}
 
-	errCb := cb() // callback
+	return deprecationInfo(v, release)
+}
+
+func deprecationInfo(v cap.Value, release string) (replacement []cap.Value, note string, ok bool) {
+	var notes []string
 
-	if !c.bypass {
-		err = c.apply(Unprivileged) // back to ring3
-		if err != nil {
-			return err
+	for _, d := range deprecations {
+		if d.value != v {
+			continue
 		}
+		cmp, err := helpers.CompareKernelRelease(d.since, release)
+		if err != nil || cmp == helpers.KernelVersionOlder {
+			continue
+		}
+		replacement = append(replacement, d.replacement...)
+		notes = append(notes, d.note)
 	}
 
-	return errCb
+	return replacement, strings.Join(notes, "; "), len(replacement) > 0
 }
 
-// Required is a protection ring with only the required caps set as Effective.
-func (c *Capabilities) Required(cb func() error) error {
-	var err error
+// sortValues sorts capabilities in place.
+func sortValues(values []cap.Value) {
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+}
 
-	if !c.bypass {
-		c.lock.Lock()
-		defer c.lock.Unlock()
+// capNames returns the names of the given capabilities.
+func capNames(values []cap.Value) []string {
+	var names []string
+	for _, v := range values {
+		names = append(names, NameOf(v))
+	}
 
-		err = c.apply(Required) // ring1 as effective
-		if err != nil {
-			return err
+	return names
+}
+
+// dedupValues returns the given values without duplicates, in order.
+func dedupValues(values []cap.Value) []cap.Value {
+	var unique []cap.Value
+	seen := make(map[cap.Value]bool)
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
 		}
 	}
 
-	errCb := cb() // callback
+	return unique
+}
 
-	if !c.bypass {
-		err = c.apply(Unprivileged) // back to ring3
-		if err != nil {
-			return err
+// stateOf returns the state of the Effective, Permitted and Inheritable flags of
+// a capability set.
+func stateOf(set *cap.Set) CapState {
+	var state CapState
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		if on, _ := set.GetFlag(cap.Effective, v); on {
+			state.Effective = append(state.Effective, v)
+		}
+		if on, _ := set.GetFlag(cap.Permitted, v); on {
+			state.Permitted = append(state.Permitted, v)
+		}
+		if on, _ := set.GetFlag(cap.Inheritable, v); on {
+			state.Inheritable = append(state.Inheritable, v)
 		}
 	}
 
-	return errCb
+	return state
 }
 
-// Requested is a protection ring that needs configuration each time it is
-// called. Instead of making Required capabilities Effective, like Required(),
-// it sets as Effective only given capabilities, for a single time, until the
-// next ring is called. It is specially needed for startup/shutdown actions that
-// might require specific capabilities Effective.
-func (c *Capabilities) Requested(cb func() error, values ...cap.Value) error {
-	var err error
-
-	if !c.bypass {
-		c.lock.Lock()
-		defer c.lock.Unlock()
+// runConfined runs the callback in a disposable OS thread (see cap.FuncLauncher)
+// with the given capabilities cleared from its Effective and Permitted sets. A
+// panic in the callback is propagated to the caller, after the thread is gone.
+func runConfined(cb func() error, values ...cap.Value) error {
+	var errCb error
+	var panicked bool
+	var recovered interface{}
 
-		err = c.set(Requested, values...)
+	launcher := cap.FuncLauncher(func(interface{}) error {
+		set, err := cap.GetPID(0)
 		if err != nil {
 			return err
 		}
-		err = c.apply(Requested) // ring2 as effective
+		err = set.SetFlag(cap.Effective, false, values...)
 		if err != nil {
 			return err
 		}
-		err = c.unset(Requested, values...) // clean requested (for next calls)
+		err = set.SetFlag(cap.Permitted, false, values...)
 		if err != nil {
 			return err
 		}
-	}
-
-	errCb := cb()
-
-	if !c.bypass {
-		err := c.apply(Unprivileged)
+		err = set.SetProc() // only affects the launcher thread
 		if err != nil {
 			return err
 		}
+
+		panicked = true
+		defer func() {
+			if panicked {
+				recovered = recover()
+			}
+		}()
+		errCb = cb() // callback
+		panicked = false
+
+		return nil
+	})
+
+	_, err := launcher.Launch(nil)
+	if panicked {
+		panic(recovered)
+	}
+	if err != nil {
+		return couldNotConfine(err)
 	}
 
 	return errCb
 }
 
-// setters/getters
+// ListAvailCaps lists available capabilities in the running environment
+func ListAvailCaps() []string {
+	_, availCaps := capsByName()
 
-// Require is called after initialization, configures all required capabilities,
-// and those required capabilities are set as Effective each time Required() is
-// called.
-func (c *Capabilities) Require(values ...cap.Value) error {
-	var err error
+	return append([]string{}, availCaps...)
+}
 
-	if c.bypass {
-		return nil
-	}
+var byNameOnce sync.Once
+var byName map[string]cap.Value // capabilities by name (without "cap_" prefix)
+var availNames []string         // capabilities names, by value
 
-	c.lock.Lock()                    // do not change caps while in a protective ring
-	err = c.set(Required, values...) // populate ring1 (Required)
-	c.lock.Unlock()
+// capsByName returns the capabilities by name (without "cap_" prefix), and the
+// capabilities names by value. They are only built once.
+func capsByName() (map[string]cap.Value, []string) {
+	byNameOnce.Do(func() {
+		byName = make(map[string]cap.Value)
+		for v := cap.Value(0); v < cap.MaxBits(); v++ {
+			byName[strings.TrimPrefix(v.String(), "cap_")] = v
+			availNames = append(availNames, v.String())
+		}
+	})
 
-	return err
+	return byName, availNames
 }
 
-// Unrequire is only called when command line "capabilities drop=X" is given.
-// It works by removing, from the required ring, the capabilities given by the
-// user. This way, when tracee shifts to ring1 (Required), that capability won't
-// be Effective.
-func (c *Capabilities) Unrequire(values ...cap.Value) error {
-	var err error
-
-	if c.bypass {
-		return nil
+// NameOf returns the name of the given capability (like "cap_bpf"), without
+// calling into libcap once the names are known.
+func NameOf(v cap.Value) string {
+	_, names := capsByName()
+	if int(v) < len(names) {
+		return names[v]
 	}
 
-	c.lock.Lock()                      // do not change caps while in an protective ring
-	err = c.unset(Required, values...) // unpopulate ring1 (Required)
-	c.lock.Unlock()
-
-	return err
+	return v.String() // not supported by the kernel
 }
 
-// Private Methods
+// ValueOf returns the capability of the given name, case insensitive and with
+// or without the "cap_" prefix, telling whether the name is known.
+func ValueOf(name string) (cap.Value, bool) {
+	known, _ := capsByName()
+	v, ok := known[strings.TrimPrefix(strings.ToLower(name), "cap_")]
 
-func (c *Capabilities) getProc() error {
-	var err error
+	return v, ok
+}
 
-	c.have, err = cap.GetPID(0)
-	if err != nil {
-		return couldNotGetProc(err)
+// builtinFeatureCaps returns the minimal capabilities needed by a builtin
+// feature. Without cap.BPF support all features fall back to cap.SYS_ADMIN.
+func builtinFeatureCaps(feature string, hasBPF bool) ([]cap.Value, error) {
+	switch feature {
+	case FeatureBPF:
+		if hasBPF {
+			return []cap.Value{cap.BPF}, nil
+		}
+	case FeaturePerf:
+		if hasBPF {
+			return []cap.Value{cap.PERFMON}, nil
+		}
+	default:
+		return nil, couldNotFindFeature(feature)
 	}
 
-	return nil
+	return []cap.Value{cap.SYS_ADMIN}, nil
 }
 
-func (c *Capabilities) setProc() error {
-	err := c.have.SetProc()
+// PreferredBPFCaps tells, without changing anything, the capabilities the
+// initialization would require for the builtin features (see Features) on this
+// host, and why: cap.BPF and cap.PERFMON if the kernel supports them,
+// cap.SYS_ADMIN otherwise, or in addition when perf_event_paranoid is above the
+// default threshold (see ParanoidThreshold). The reason also tells whether they
+// are not permitted.
+func PreferredBPFCaps() ([]cap.Value, string, error) {
+	release, err := kernelRelease()
 	if err != nil {
-		return couldNotSetProc(err)
+		return nil, "", couldNotProbeBPFCaps(err)
 	}
+	_, err = getBound(cap.BPF)
+	hasBPF, support := kernelBPFSupport(release, cap.BPF < cap.MaxBits() && err == nil)
 
-	return nil
-}
+	var values []cap.Value
+	for _, feature := range []string{FeatureBPF, FeaturePerf} {
+		builtin, _ := builtinFeatureCaps(feature, hasBPF)
+		values = append(values, builtin...)
+	}
+
+	reason := "kernel does not support CAP_BPF"
+	if hasBPF {
+		reason = "kernel supports CAP_BPF (" + support + ")"
+		threshold := newDefaultOptions().ParanoidThreshold
+		paranoid, err := getKernelPerfEventParanoidValue(perfEventParanoidFile)
+		switch {
+		case err != nil:
+			values = append(values, cap.SYS_ADMIN)
+			reason = fmt.Sprintf("perf_event_paranoid unknown, assuming %v > %v", paranoid, threshold)
+		case paranoid > threshold:
+			values = append(values, cap.SYS_ADMIN)
+			reason = fmt.Sprintf("paranoid=%v > %v", paranoid, threshold)
+		default:
+			reason += fmt.Sprintf(", paranoid=%v <= %v", paranoid, threshold)
+		}
+	}
+	values = dedupValues(values)
+	sortValues(values)
 
-func (c *Capabilities) set(t ringType, values ...cap.Value) error {
+	var missing []cap.Value
+	current := getThreadCaps()
 	for _, v := range values {
-		c.all[v][t] = true
+		permitted, err := current.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		reason += ", " + strings.Join(capNames(missing), ", ") + " not permitted"
 	}
 
-	return nil
+	return values, reason, nil
 }
 
-func (c *Capabilities) unset(t ringType, values ...cap.Value) error {
-	for _, v := range values {
-		c.all[v][t] = false
+// BoundingSetEmpty tells whether the bounding set is empty, as intended by the
+// initialization (so exec()ed programs can't inherit capabilities), returning
+// the capabilities still in the bounding set otherwise.
+func BoundingSetEmpty() (bool, []cap.Value, error) {
+	var bound []cap.Value
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		on, err := getBound(v)
+		if err != nil {
+			return false, nil, couldNotGetBound(err)
+		}
+		if on {
+			bound = append(bound, v)
+		}
 	}
 
-	return nil
+	return len(bound) == 0, bound, nil
 }
 
-func (c *Capabilities) apply(t ringType) error {
-	var err error
+// DiffFromParent compares the capabilities of the current process against the
+// ones of its parent: capabilities added are the ones the current process has
+// and its parent does not. It reveals whether a launcher or supervisor changed
+// the capabilities before tracee started.
+func DiffFromParent() (StateDiff, error) {
+	ppid := os.Getppid()
 
-	err = c.getProc()
+	diff, err := diffStatus(fmt.Sprintf("/proc/%v/status", ppid), "/proc/self/status")
+	if errors.Is(err, os.ErrNotExist) {
+		return StateDiff{}, couldNotDiffFromParent(fmt.Errorf("parent %v has exited", ppid))
+	}
 	if err != nil {
-		return err
+		return StateDiff{}, couldNotDiffFromParent(err)
 	}
 
-	logger.Debug("capabilities change", "pkg", pkgName)
+	return diff, nil
+}
 
-	for k, v := range c.all {
-		if v[t] {
-			logger.Debug("enabling", "pkg", pkgName, "cap", k)
+// Snapshot returns a copy of the current capabilities of the process, as the
+// kernel has them, to be compared later on (see Diff).
+func Snapshot() (*cap.Set, error) {
+	set, err := getPID(0)
+	if err != nil {
+		return nil, couldNotSnapshot(err)
+	}
+
+	return set, nil
+}
+
+// Diff compares two capability sets, flag by flag: capabilities added are the
+// ones b has and a does not. A nil set has no capabilities.
+func Diff(a, b *cap.Set) CapDiff {
+	var diff CapDiff
+
+	if a == nil {
+		a = cap.NewSet()
+	}
+	if b == nil {
+		b = cap.NewSet()
+	}
+
+	flags := []struct {
+		flag cap.Flag
+		diff *CapFlagDiff
+	}{
+		{cap.Effective, &diff.Effective},
+		{cap.Permitted, &diff.Permitted},
+		{cap.Inheritable, &diff.Inheritable},
+	}
+
+	for _, f := range flags {
+		for v := cap.Value(0); v < cap.MaxBits(); v++ {
+			from, _ := a.GetFlag(f.flag, v)
+			to, _ := b.GetFlag(f.flag, v)
+			switch {
+			case to && !from:
+				f.diff.Added = append(f.diff.Added, v)
+			case !to && from:
+				f.diff.Removed = append(f.diff.Removed, v)
+			case to && from:
+				f.diff.Unchanged = append(f.diff.Unchanged, v)
+			}
+		}
+	}
+
+	return diff
+}
+
+// diffStatus compares the capability masks of two procfs status files.
+func diffStatus(fromFile string, toFile string) (StateDiff, error) {
+	var diff StateDiff
+
+	fields := []struct {
+		name string
+		diff *FlagDiff
+	}{
+		{"CapEff", &diff.Effective},
+		{"CapPrm", &diff.Permitted},
+		{"CapInh", &diff.Inheritable},
+		{"CapBnd", &diff.Bounding},
+	}
+
+	for _, f := range fields {
+		from, err := readStatusCaps(fromFile, f.name)
+		if err != nil {
+			return StateDiff{}, err
 		}
-		err = c.have.SetFlag(cap.Effective, v[t], k)
+		to, err := readStatusCaps(toFile, f.name)
 		if err != nil {
-			return err
+			return StateDiff{}, err
 		}
+		*f.diff = diffMasks(from, to)
 	}
 
-	return c.setProc()
+	return diff, nil
 }
 
-//
-// Error Functions
-//
+// diffMasks returns the capabilities added and removed from one mask to another.
+func diffMasks(from uint64, to uint64) FlagDiff {
+	var diff FlagDiff
+
+	for v := cap.Value(0); v < 64; v++ {
+		bit := uint64(1) << uint(v)
+		switch {
+		case to&bit != 0 && from&bit == 0:
+			diff.Added = append(diff.Added, v)
+		case to&bit == 0 && from&bit != 0:
+			diff.Removed = append(diff.Removed, v)
+		}
+	}
 
-func couldNotFindCapability(cap string) error {
-	return fmt.Errorf("could not find capability: %v", cap)
+	return diff
 }
 
-func couldNotReadPerfEventParanoid() error {
-	return fmt.Errorf("could not read procfs perf_event_paranoid")
+// isTransient tells whether the given error is worth retrying.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.EBUSY)
 }
 
-func couldNotSetProc(e error) error {
-	return fmt.Errorf("could not set capabilities: %v", e)
+// readStatusCaps reads the given capabilities mask (CapEff, CapPrm, ...) from a
+// procfs status file.
+func readStatusCaps(statusFile string, field string) (uint64, error) {
+	status, err := os.ReadFile(statusFile)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, field+":") {
+			continue
+		}
+		return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, field+":")), 16, 64)
+	}
+
+	return 0, fmt.Errorf("could not find %v in %v", field, statusFile)
 }
 
-func couldNotGetProc(e error) error {
-	return fmt.Errorf("could not get capabilities: %v", e)
+// InUserNamespace tells whether the process runs in a user namespace other
+// than the initial one (rootless containers...): its capabilities are then only
+// effective within the namespace, not on the host. The initial namespace maps
+// all user IDs to themselves.
+func InUserNamespace() bool {
+	value, err := os.ReadFile(uidMapFile)
+	if err != nil {
+		return false // no user namespaces support
+	}
+
+	return strings.Join(strings.Fields(string(value)), " ") != "0 0 4294967295"
 }
 
-//
-// Standalone Functions
-//
+// detectSandbox returns the name of the sandbox environment the process is
+// running in, based on known markers of the given kernel version file, or an
+// empty string if no sandbox was detected.
+func detectSandbox(versionFile string) string {
+	markers := []struct {
+		name   string
+		marker string
+	}{
+		{"gVisor", "gVisor"},
+		{"gVisor", "Linux version 4.4.0 #1 SMP Sun Jan 10 15:06:54 PST 2016"}, // gVisor fake kernel
+		{"WSL1", "Microsoft"},
+	}
 
-func ReqByString(values ...string) ([]cap.Value, error) {
-	var found bool
-	var capsToActOn []cap.Value
+	value, err := os.ReadFile(versionFile)
+	if err != nil {
+		return ""
+	}
 
-	for _, given := range values {
-		found = false
-		for v := cap.Value(0); v < cap.MaxBits(); v++ {
-			if v.String() == given {
-				capsToActOn = append(capsToActOn, v)
-				found = true
-			}
-		}
-		if !found {
-			return nil, couldNotFindCapability(given)
+	for _, m := range markers {
+		if strings.Contains(string(value), m.marker) {
+			return m.name
 		}
 	}
 
-	return capsToActOn, nil
+	return ""
 }
 
-// ListAvailCaps lists available capabilities in the running environment
-func ListAvailCaps() []string {
-	var availCaps []string
-
-	for v := cap.Value(0); v < cap.MaxBits(); v++ {
-		availCaps = append(availCaps, v.String())
-	}
+// Perf event paranoia levels:
+//
+//	-1 = not paranoid at all
+//	 0 = disallow raw tracepoint access for unpriv
+//	 1 = disallow cpu events for unpriv
+//	 2 = disallow kernel profiling for unpriv
+//	 4 = disallow all unpriv perf event use (not in all distros)
+const (
+	MinParanoiaLevel = -1
+	MaxParanoiaLevel = 4
 
-	return availCaps
-}
+	UnknownParanoiaLevel = -2 // perf_event_paranoid could not be read (see ParanoidLevel)
+)
 
 // getKernelPerfEventParanoidValue retrieves the value of the kernel parameter
-// perf_event_paranoid
-func getKernelPerfEventParanoidValue() (int, error) {
-	// perf event paranoia level:
-	//
-	// -1 = not paranoid at all
-	//  0 = disallow raw tracepoint access for unpriv
-	//  1 = disallow cpu events for unpriv
-	//  2 = disallow kernel profiling for unpriv
-	//  4 = disallow all unpriv perf event use (not in all distros)
-	//
-	const MaxParanoiaLevel = 4
-
-	value, err := os.ReadFile("/proc/sys/kernel/perf_event_paranoid")
+// perf_event_paranoid from the given file (its procfs file)
+func getKernelPerfEventParanoidValue(paranoidFile string) (int, error) {
+	value, err := os.ReadFile(paranoidFile)
 	if err != nil {
 		return MaxParanoiaLevel, couldNotReadPerfEventParanoid()
 	}
@@ -0,0 +1,2683 @@
+package capabilities
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aquasecurity/tracee/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// processTestsEnv enables the tests changing the capabilities, and the bounding
+// set, of the test process itself (other tests use a fake backend): they need
+// CAP_SETPCAP, and the capabilities they drop can't be regained by later tests.
+const processTestsEnv = "TRACEE_CAPABILITIES_PROCESS_TESTS"
+
+// newTestCapabilities initializes a non singleton capabilities instance
+// managing the capabilities of the test process. The test is skipped unless
+// enabled (see processTestsEnv) and the process is able to manage its own
+// capabilities.
+func newTestCapabilities(t testing.TB) *Capabilities {
+	t.Helper()
+
+	if os.Getenv(processTestsEnv) == "" {
+		t.Skipf("test changes the process capabilities, set %s=1 to run it", processTestsEnv)
+	}
+
+	have, err := cap.GetPID(0)
+	require.NoError(t, err)
+	setpcap, err := have.GetFlag(cap.Permitted, cap.SETPCAP)
+	require.NoError(t, err)
+	if !setpcap {
+		t.Skip("test requires CAP_SETPCAP in the permitted set")
+	}
+
+	// start as a freshly executed process: all permitted capabilities effective
+	require.NoError(t, have.Fill(cap.Effective, cap.Permitted))
+	require.NoError(t, have.SetProc())
+
+	c := &Capabilities{}
+	initializeTest(t, c)
+
+	_, missing := c.CanEnter(Required) // environment might lack base required
+	require.NoError(t, c.ForceUnrequire(missing...))
+
+	return c
+}
+
+// initializeTest initializes the given instance, managing capabilities.
+func initializeTest(t testing.TB, c *Capabilities, opts ...Option) {
+	t.Helper()
+
+	require.NoError(t, c.initialize(false, opts...))
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs redirects the package-level logger to a buffer until the test
+// finishes.
+func captureLogs(t testing.TB) *syncBuffer {
+	t.Helper()
+
+	buf := &syncBuffer{}
+	cfg := logger.NewDefaultLoggerConfig()
+	cfg.Writer = buf
+	cfg.Level = logger.DebugLevel
+
+	old := logger.Base()
+	logger.SetBase(logger.NewLogger(cfg))
+	t.Cleanup(func() { logger.SetBase(old) })
+
+	return buf
+}
+
+// newFakeCapabilities returns a capabilities instance, not initialized, whose
+// permitted set is the given one. It is meant for tests not changing the
+// process capabilities.
+func newFakeCapabilities(t *testing.T, permitted ...cap.Value) *Capabilities {
+	t.Helper()
+
+	c := &Capabilities{
+		have:     cap.NewSet(),
+		all:      make(map[cap.Value]map[Ring]bool),
+		confined: make(map[Ring][]cap.Value),
+		features: make(map[string][]cap.Value),
+		reasons:  make(map[cap.Value][]string),
+		lock:     new(sync.RWMutex),
+		opts:     newDefaultOptions(),
+	}
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		c.all[v] = map[Ring]bool{Privileged: true}
+	}
+	require.NoError(t, c.have.SetFlag(cap.Permitted, true, permitted...))
+
+	return c
+}
+
+// hasFlag reads the given flag of the calling thread for the given capability.
+func hasFlag(t testing.TB, flag cap.Flag, v cap.Value) bool {
+	t.Helper()
+
+	have, err := cap.GetPID(0)
+	require.NoError(t, err)
+	on, err := have.GetFlag(flag, v)
+	require.NoError(t, err)
+
+	return on
+}
+
+// requirePermitted skips the test if any of the given capabilities is not in
+// the permitted set.
+func requirePermitted(t testing.TB, values ...cap.Value) {
+	t.Helper()
+
+	for _, v := range values {
+		if !hasFlag(t, cap.Permitted, v) {
+			t.Skipf("test requires %v in the permitted set", v)
+		}
+	}
+}
+
+func TestConfine(t *testing.T) {
+	c := newTestCapabilities(t)
+	requirePermitted(t, cap.NET_RAW, cap.NET_ADMIN)
+
+	require.NoError(t, c.Confine(Requested, cap.NET_RAW))
+	defer c.Unconfine(Requested)
+
+	t.Run("permitted is restored after the scope", func(t *testing.T) {
+		err := c.Requested(func() error {
+			assert.False(t, hasFlag(t, cap.Permitted, cap.NET_RAW))
+			assert.False(t, hasFlag(t, cap.Effective, cap.NET_RAW))
+			assert.True(t, hasFlag(t, cap.Effective, cap.NET_ADMIN))
+			return nil
+		}, cap.NET_RAW, cap.NET_ADMIN)
+		require.NoError(t, err)
+
+		assert.True(t, hasFlag(t, cap.Permitted, cap.NET_RAW))
+		assert.False(t, hasFlag(t, cap.Effective, cap.NET_ADMIN))
+	})
+
+	t.Run("permitted is restored after a panic", func(t *testing.T) {
+		assert.Panics(t, func() {
+			c.Requested(func() error {
+				panic("confined callback")
+			}, cap.NET_ADMIN)
+		})
+
+		assert.True(t, hasFlag(t, cap.Permitted, cap.NET_RAW))
+		require.NoError(t, c.Requested(func() error { return nil })) // lock was released
+	})
+
+	t.Run("unconfined ring keeps permitted", func(t *testing.T) {
+		require.NoError(t, c.Unconfine(Requested))
+		err := c.Requested(func() error {
+			assert.True(t, hasFlag(t, cap.Permitted, cap.NET_RAW))
+			assert.True(t, hasFlag(t, cap.Effective, cap.NET_RAW))
+			return nil
+		}, cap.NET_RAW)
+		require.NoError(t, err)
+	})
+}
+
+func TestConfinedCallback(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	require.NoError(t, c.Confine(Required, cap.SYS_ADMIN))
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Required(func() error {
+			assert.NotZero(t, atomic.LoadInt32(&c.confinedTID))
+			// readers and mutators work, but rings can't be entered
+			assert.Equal(t, Required, c.EffectiveRing())
+			assert.NoError(t, c.Require(cap.NET_ADMIN))
+			err := c.Requested(func() error { return nil }, cap.NET_ADMIN)
+			assert.ErrorContains(t, err, "confined callback")
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock within a confined callback")
+	}
+	assert.Zero(t, atomic.LoadInt32(&c.confinedTID))
+	assert.Contains(t, c.ListRequired(), cap.NET_ADMIN)
+	assert.Empty(t, b.effective())
+}
+
+func TestOnSetProc(t *testing.T) {
+	var count int
+	var last CapState
+
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN}, OnSetProc(func(state CapState) {
+		count++
+		last = state
+	}))
+
+	assert.Equal(t, 2, count) // bounding set drop + unprivileged ring
+	assert.Empty(t, last.Effective)
+	assert.NotEmpty(t, last.Permitted)
+
+	err := c.Requested(func() error {
+		assert.Equal(t, 3, count)
+		assert.Equal(t, []cap.Value{cap.NET_ADMIN}, last.Effective)
+		return nil
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+
+	assert.Equal(t, 4, count)
+	assert.Empty(t, last.Effective)
+}
+
+func TestDetectCreep(t *testing.T) {
+	c, _ := newFakeProcess(t, nil, DetectCreep(true))
+	assert.Empty(t, c.Info().Creep)
+
+	required := c.Info().Required
+	require.NotEmpty(t, required)
+	require.NoError(t, c.Require(required...)) // already required: no creep
+	assert.Empty(t, c.Info().Creep)
+
+	require.NoError(t, c.Require(cap.NET_ADMIN))
+	creep := c.Info().Creep
+	require.Len(t, creep, 1)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, creep[0].Values)
+	assert.Contains(t, creep[0].Caller, "capabilities_test.go")
+
+	require.NoError(t, c.Require(cap.NET_ADMIN)) // already reported
+	assert.Len(t, c.Info().Creep, 1)
+}
+
+func TestCanEnter(t *testing.T) {
+	c := newFakeCapabilities(t, cap.IPC_LOCK, cap.BPF)
+	require.NoError(t, c.Require(cap.IPC_LOCK, cap.BPF))
+
+	ok, missing := c.CanEnter(Required)
+	assert.True(t, ok)
+	assert.Empty(t, missing)
+
+	require.NoError(t, c.Require(cap.PERFMON, cap.SYS_ADMIN))
+	ok, missing = c.CanEnter(Required)
+	assert.False(t, ok)
+	assert.Equal(t, []cap.Value{cap.SYS_ADMIN, cap.PERFMON}, missing)
+
+	ok, _ = c.CanEnter(Unprivileged)
+	assert.True(t, ok)
+
+	ok, missing = c.CanEnter(Privileged)
+	assert.False(t, ok)
+	assert.Len(t, missing, int(cap.MaxBits())-2)
+}
+
+func TestForFeature(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN, cap.NET_RAW))
+	assert.Subset(t, c.Info().Required, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	t.Run("registered feature", func(t *testing.T) {
+		err := c.ForFeature("network", func() error {
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			assert.Contains(t, b.effective(), cap.NET_RAW)
+			assert.NotContains(t, b.effective(), cap.IPC_LOCK)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+	})
+
+	t.Run("unknown feature", func(t *testing.T) {
+		called := false
+		err := c.ForFeature("unknown", func() error {
+			called = true
+			return nil
+		})
+		assert.EqualError(t, err, "could not find feature: unknown")
+		assert.False(t, called)
+	})
+}
+
+func TestInUserNamespace(t *testing.T) {
+	old := uidMapFile
+	defer func() { uidMapFile = old }()
+
+	dir := t.TempDir()
+	uidMapFile = filepath.Join(dir, "uid_map")
+
+	require.NoError(t, os.WriteFile(uidMapFile, []byte("         0          0 4294967295\n"), 0644))
+	assert.False(t, InUserNamespace())
+	require.NoError(t, os.WriteFile(uidMapFile, []byte("         0       1000          1\n"), 0644))
+	assert.True(t, InUserNamespace())
+
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN)
+	c := &Capabilities{backend: b}
+	logs := captureLogs(t)
+	require.NoError(t, c.initialize(false))
+	assert.True(t, c.Info().UserNamespace)
+	assert.Contains(t, logs.String(), "required capabilities won't be effective on the host")
+	for _, d := range c.InitDecisions() {
+		if d.Point == "strategy" {
+			assert.Equal(t, "true", d.Inputs["userNamespace"])
+			assert.Contains(t, d.Outcome, "user namespace")
+		}
+	}
+
+	uidMapFile = filepath.Join(dir, "missing")
+	assert.False(t, InUserNamespace())
+}
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	gvisor := filepath.Join(dir, "gvisor")
+	require.NoError(t, os.WriteFile(gvisor, []byte("Linux version 4.4.0 #1 SMP Sun Jan 10 15:06:54 PST 2016\n"), 0644))
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regular, []byte("Linux version 5.15.0-48-generic (buildd@lcy02-amd64-080)\n"), 0644))
+
+	assert.Equal(t, "gVisor", detectSandbox(gvisor))
+	assert.Equal(t, "", detectSandbox(regular))
+	assert.Equal(t, "", detectSandbox(filepath.Join(dir, "missing")))
+
+	old := procVersionFile
+	procVersionFile = gvisor
+	defer func() { procVersionFile = old }()
+
+	c := &Capabilities{}
+	initializeTest(t, c, SandboxBypass(true))
+	info := c.Info()
+	assert.True(t, info.Bypass)
+	assert.Equal(t, "gVisor", info.Sandbox)
+	assert.Empty(t, info.Required)
+}
+
+func TestRequestedSet(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	_, err := PrepareCapSet("cap_net_admin", "bogus")
+	assert.EqualError(t, err, "could not find capability: bogus")
+
+	set, err := PrepareCapSet("cap_net_admin", "cap_net_raw")
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW}, set.Values())
+
+	err = c.RequestedSet(func() error {
+		assert.Contains(t, b.effective(), cap.NET_ADMIN)
+		assert.Contains(t, b.effective(), cap.NET_RAW)
+		return nil
+	}, set)
+	require.NoError(t, err)
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+}
+
+func TestRequestedNilSet(t *testing.T) {
+	c := newFakeCapabilities(t, cap.NET_ADMIN)
+
+	called := false
+	err := c.RequestedSet(func() error {
+		called = true
+		return nil
+	}, nil)
+	assert.EqualError(t, err, "could not use nil capability set")
+	assert.False(t, called)
+}
+
+func BenchmarkRequestedByName(b *testing.B) {
+	c, _ := newFakeProcess(b, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	cb := func() error { return nil }
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.RequestedByName(cb, "cap_net_admin", "cap_net_raw")
+	}
+}
+
+func BenchmarkRequestedSet(b *testing.B) {
+	c, _ := newFakeProcess(b, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	cb := func() error { return nil }
+	set, err := PrepareCapSet("cap_net_admin", "cap_net_raw")
+	require.NoError(b, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = c.RequestedSet(cb, set)
+	}
+}
+
+// BenchmarkReadsDuringRequired measures state reads, from many goroutines,
+// while another goroutine keeps entering the required ring. Readers only
+// contend with ring transitions, not with each other.
+func BenchmarkReadsDuringRequired(b *testing.B) {
+	c, _ := newFakeProcess(b, nil)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				_ = c.Required(func() error { return nil })
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = c.EffectiveRing()
+			_, _ = c.CanEnter(Required)
+		}
+	})
+}
+
+func TestBuiltinFeatures(t *testing.T) {
+	testCases := []struct {
+		name     string
+		feature  string
+		hasBPF   bool
+		expected []cap.Value
+		err      string
+	}{
+		{name: "bpf", feature: FeatureBPF, hasBPF: true, expected: []cap.Value{cap.BPF}},
+		{name: "perf", feature: FeaturePerf, hasBPF: true, expected: []cap.Value{cap.PERFMON}},
+		{name: "bpf without cap.BPF", feature: FeatureBPF, expected: []cap.Value{cap.SYS_ADMIN}},
+		{name: "perf without cap.BPF", feature: FeaturePerf, expected: []cap.Value{cap.SYS_ADMIN}},
+		{name: "unknown", feature: "unknown", hasBPF: true, err: "could not find feature: unknown"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			values, err := builtinFeatureCaps(tc.feature, tc.hasBPF)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, values)
+		})
+	}
+
+	fakeKernelRelease(t, "5.15.0") // supporting cap.BPF
+
+	t.Run("perf only", func(t *testing.T) {
+		c, _ := newFakeProcess(t, nil, Features(FeaturePerf))
+		info := c.Info()
+		assert.Contains(t, info.Required, cap.PERFMON)
+		assert.NotContains(t, info.Required, cap.BPF)
+		assert.Contains(t, info.Features, FeaturePerf)
+		assert.NotContains(t, info.Features, FeatureBPF)
+	})
+
+	t.Run("bpf only", func(t *testing.T) {
+		c, _ := newFakeProcess(t, nil, Features(FeatureBPF))
+		info := c.Info()
+		assert.Contains(t, info.Required, cap.BPF)
+		assert.NotContains(t, info.Required, cap.PERFMON)
+		assert.NotContains(t, info.Required, cap.SYS_ADMIN) // paranoid only matters to perf
+		assert.Equal(t, []cap.Value{cap.BPF}, info.Features[FeatureBPF])
+	})
+}
+
+func TestSimulateDrop(t *testing.T) {
+	c := newFakeCapabilities(t)
+	require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN, cap.NET_RAW))
+	require.NoError(t, c.RequireForFeature("containers", cap.SYS_PTRACE, cap.NET_ADMIN))
+	require.NoError(t, c.RequireForFeature("symbols", cap.SYSLOG))
+
+	assert.Equal(t, []string{"containers", "network"}, c.SimulateDrop(cap.NET_ADMIN))
+	assert.Equal(t, []string{"symbols"}, c.SimulateDrop(cap.SYSLOG))
+	assert.Empty(t, c.SimulateDrop(cap.CHOWN))
+	assert.True(t, c.all[cap.NET_ADMIN][Required]) // nothing was dropped
+}
+
+func TestDumpStateToFile(t *testing.T) {
+	c := newFakeCapabilities(t)
+	c.opts.DetectCreep = true
+	c.baseline = map[cap.Value]bool{}
+	require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN, cap.NET_RAW))
+	require.NoError(t, c.Require(cap.SYSLOG))
+
+	path := filepath.Join(t.TempDir(), "caps.json")
+	require.NoError(t, os.WriteFile(path, []byte("stale"), 0600))
+	require.NoError(t, c.DumpStateToFile(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var dump stateFile
+	require.NoError(t, json.Unmarshal(data, &dump))
+	assert.Equal(t, StateSchemaVersion, dump.SchemaVersion)
+	assert.Equal(t, c.Info(), dump.Info)
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1) // no temporary files left behind
+
+	assert.Error(t, c.DumpStateToFile(filepath.Join(path, "not-a-dir", "caps.json")))
+}
+
+func TestRequiredDeadline(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+	require.NoError(t, c.Require(cap.NET_ADMIN))
+	logs := captureLogs(t)
+
+	t.Run("fast callback", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		err := c.RequiredDeadline(ctx, func() error {
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.NotContains(t, logs.String(), "exceeded its deadline")
+	})
+
+	t.Run("callback blocking past the deadline", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+
+		err := c.RequiredDeadline(ctx, func() error {
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond) // warning is logged meanwhile
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			return nil
+		})
+		require.NoError(t, err)
+		assert.Contains(t, logs.String(), "required ring callback exceeded its deadline")
+		assert.Contains(t, logs.String(), "TestRequiredDeadline")
+		assert.NotContains(t, b.effective(), cap.NET_ADMIN) // restored
+	})
+}
+
+func TestDeprecationInfo(t *testing.T) {
+	testCases := []struct {
+		name        string
+		value       cap.Value
+		release     string
+		replacement []cap.Value
+		ok          bool
+	}{
+		{
+			name:        "sys_admin on 5.8+",
+			value:       cap.SYS_ADMIN,
+			release:     "5.8.0-63-generic",
+			replacement: []cap.Value{cap.SYSLOG, cap.BPF, cap.PERFMON},
+			ok:          true,
+		},
+		{
+			name:        "sys_admin on 5.9+",
+			value:       cap.SYS_ADMIN,
+			release:     "5.15.0-48-generic",
+			replacement: []cap.Value{cap.SYSLOG, cap.BPF, cap.PERFMON, cap.CHECKPOINT_RESTORE},
+			ok:          true,
+		},
+		{
+			name:        "sys_admin before 5.8",
+			value:       cap.SYS_ADMIN,
+			release:     "4.18.0-305.12.1.el8_4.x86_64",
+			replacement: []cap.Value{cap.SYSLOG},
+			ok:          true,
+		},
+		{
+			name:    "not deprecated",
+			value:   cap.NET_ADMIN,
+			release: "5.15.0-48-generic",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			replacement, note, ok := deprecationInfo(tc.value, tc.release)
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.replacement, replacement)
+			if tc.ok {
+				assert.Contains(t, note, "carved out of CAP_SYS_ADMIN")
+			} else {
+				assert.Empty(t, note)
+			}
+		})
+	}
+
+	deprecatedOnce.Delete(cap.SYS_ADMIN) // warned by previous tests
+	logs := captureLogs(t)
+	for i := 0; i < 3; i++ { // warned only once
+		_, err := ReqByString("cap_sys_admin", "sys_admin")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, strings.Count(logs.String(), "capability has narrower replacements"))
+}
+
+func TestRingsPinThread(t *testing.T) {
+	c := newTestCapabilities(t)
+	requirePermitted(t, cap.NET_ADMIN)
+
+	ring := func(cb func() error) error { return c.Requested(cb, cap.NET_ADMIN) }
+	if ok, _ := c.CanEnter(Privileged); ok {
+		ring = c.Privileged
+	}
+
+	var wg sync.WaitGroup
+	var lacking int32
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := ring(func() error {
+				for j := 0; j < 10; j++ {
+					runtime.Gosched() // give the scheduler chances to migrate
+
+					have, err := cap.GetPID(0) // calling thread
+					if err != nil {
+						return err
+					}
+					if on, _ := have.GetFlag(cap.Effective, cap.NET_ADMIN); !on {
+						atomic.AddInt32(&lacking, 1)
+					}
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Zero(t, atomic.LoadInt32(&lacking))
+	assert.False(t, hasFlag(t, cap.Effective, cap.NET_ADMIN))
+}
+
+func TestPrivilegedAllThreads(t *testing.T) {
+	c := newTestCapabilities(t)
+	requirePermitted(t, cap.NET_ADMIN)
+
+	// spread the process over a few more OS threads
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 4; i++ {
+		go func() {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			<-release
+		}()
+	}
+
+	require.NoError(t, c.verifyAllThreads())
+
+	c.lock.Lock()
+	require.NoError(t, c.set(Requested, cap.NET_ADMIN))
+	require.NoError(t, c.apply(Requested))
+	assert.NoError(t, c.verifyAllThreads())
+	require.NoError(t, c.unset(Requested, cap.NET_ADMIN))
+	require.NoError(t, c.apply(Unprivileged))
+	c.lock.Unlock()
+
+	if ok, _ := c.CanEnter(Privileged); !ok {
+		t.Skip("test requires all capabilities in the permitted set")
+	}
+	err := c.PrivilegedAllThreads(func() error {
+		assert.True(t, hasFlag(t, cap.Effective, cap.NET_ADMIN))
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestDebugVerifyThreads(t *testing.T) {
+	newTestCapabilities(t) // skip unless enabled, and privileged
+	requirePermitted(t, cap.NET_ADMIN)
+
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 4; i++ {
+		go func() {
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
+			<-release
+		}()
+	}
+
+	c := &Capabilities{}
+	initializeTest(t, c, DebugVerifyThreads(true))
+
+	err := c.Requested(func() error {
+		assert.True(t, hasFlag(t, cap.Effective, cap.NET_ADMIN))
+		return nil
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+}
+
+func TestBoundingSetEmpty(t *testing.T) {
+	old := getBound
+	defer func() { getBound = old }()
+
+	bounded := map[cap.Value]bool{}
+	getBound = func(v cap.Value) (bool, error) {
+		return bounded[v], nil
+	}
+
+	empty, bound, err := BoundingSetEmpty()
+	require.NoError(t, err)
+	assert.True(t, empty)
+	assert.Empty(t, bound)
+
+	bounded[cap.SYS_ADMIN] = true // partially dropped
+	bounded[cap.NET_ADMIN] = true
+	empty, bound, err = BoundingSetEmpty()
+	require.NoError(t, err)
+	assert.False(t, empty)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.SYS_ADMIN}, bound)
+
+	info := newFakeCapabilities(t).Info()
+	assert.False(t, info.BoundingSetEmpty)
+	assert.Equal(t, bound, info.Bound)
+
+	getBound = func(v cap.Value) (bool, error) {
+		return false, errors.New("not supported")
+	}
+	_, _, err = BoundingSetEmpty()
+	assert.EqualError(t, err, "could not get bounding set: not supported")
+}
+
+func TestSetAuditWriter(t *testing.T) {
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	audit := &syncBuffer{}
+	c.SetAuditWriter(audit)
+
+	require.NoError(t, c.Require(cap.NET_ADMIN))
+	require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN, cap.NET_RAW))
+	require.NoError(t, c.Requested(func() error { return nil }, cap.NET_ADMIN))
+	require.NoError(t, c.ForceUnrequire(cap.NET_ADMIN, cap.NET_RAW))
+
+	c.SetAuditWriter(nil)
+	require.NoError(t, c.Require(cap.NET_ADMIN)) // not audited
+
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var entry auditEntry
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		assert.False(t, entry.Time.IsZero())
+		entry.Time = time.Time{}
+		entries = append(entries, entry)
+	}
+
+	assert.Equal(t, []auditEntry{
+		{Operation: "require", Ring: "required", Raised: []string{"cap_net_admin"}},
+		{Operation: "require", Ring: "required", Feature: "network", Raised: []string{"cap_net_raw"}},
+		{Operation: "transition", Ring: "requested", Raised: []string{"cap_net_admin"}},
+		{Operation: "transition", Ring: "unprivileged", Lowered: []string{"cap_net_admin"}},
+		{Operation: "unrequire", Ring: "required", Lowered: []string{"cap_net_admin", "cap_net_raw"}},
+	}, entries)
+}
+
+func TestExplain(t *testing.T) {
+	t.Run("reasons", func(t *testing.T) {
+		c := newFakeCapabilities(t)
+		require.NoError(t, c.Require(cap.IPC_LOCK))
+		c.because("base requirement", cap.IPC_LOCK)
+		require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN))
+		require.NoError(t, c.RequireForFeature("containers", cap.NET_ADMIN, cap.SYS_PTRACE))
+		require.NoError(t, c.Require(cap.SYSLOG))
+
+		assert.Equal(t, []CapExplanation{
+			{Value: cap.NET_ADMIN, Name: "cap_net_admin", Reasons: []string{"feature: containers", "feature: network"}},
+			{Value: cap.IPC_LOCK, Name: "cap_ipc_lock", Reasons: []string{"base requirement"}},
+			{Value: cap.SYS_PTRACE, Name: "cap_sys_ptrace", Reasons: []string{"feature: containers"}},
+			{Value: cap.SYSLOG, Name: "cap_syslog", Reasons: []string{"runtime requirement"}},
+		}, c.Explain())
+	})
+
+	t.Run("strategy", func(t *testing.T) {
+		fakeKernelRelease(t, "5.15.0") // supporting cap.BPF
+		c, _ := newFakeProcess(t, nil)
+
+		var bpf *CapExplanation
+		explanations := c.Explain()
+		for i := range explanations {
+			if explanations[i].Value == cap.BPF {
+				bpf = &explanations[i]
+			}
+		}
+		require.NotNil(t, bpf)
+		assert.Contains(t, bpf.Reasons, "feature: bpf")
+		assert.Contains(t, bpf.Reasons, "strategy: kernel supports CAP_BPF (v5.8 or newer), CAP_BPF and CAP_PERFMON used instead of CAP_SYS_ADMIN")
+	})
+}
+
+func TestSeal(t *testing.T) {
+	c := newFakeCapabilities(t)
+
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+	require.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN))
+
+	c.Seal()
+
+	assert.NoError(t, c.Require(cap.IPC_LOCK)) // no growth
+	assert.NoError(t, c.RequireForFeature("network", cap.NET_ADMIN))
+	assert.EqualError(t, c.Require(cap.IPC_LOCK, cap.SYS_ADMIN),
+		"could not require capabilities [cap_sys_admin]: required capabilities are sealed")
+	assert.Error(t, c.RequireForFeature("symbols", cap.SYSLOG))
+
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.IPC_LOCK}, c.Info().Required)
+	assert.NotContains(t, c.Info().Features, "symbols")
+}
+
+func TestRequireForFeatureOnKernel(t *testing.T) {
+	testCases := []struct {
+		name     string
+		release  string
+		required []cap.Value
+		reasons  []string
+	}{
+		{
+			name:     "older kernel",
+			release:  "5.4.0-126-generic",
+			required: []cap.Value{cap.SYS_ADMIN},
+		},
+		{
+			name:     "newer kernel",
+			release:  "5.15.0-48-generic",
+			required: []cap.Value{cap.SYS_ADMIN, cap.PERFMON, cap.BPF},
+			reasons:  []string{"kernel: 5.15.0-48-generic is 5.8 or newer (feature: tracing)", "feature: tracing"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newFakeCapabilities(t)
+			c.release = tc.release
+
+			require.NoError(t, c.RequireForFeature("tracing", cap.SYS_ADMIN))
+			require.NoError(t, c.RequireForFeatureOnKernel("tracing", "5.8", cap.BPF, cap.PERFMON))
+			assert.Equal(t, tc.required, c.Info().Required)
+
+			for _, e := range c.Explain() {
+				if e.Value == cap.BPF {
+					assert.Equal(t, tc.reasons, e.Reasons)
+				}
+			}
+		})
+	}
+
+	c := newFakeCapabilities(t)
+	c.release = "5.15.0-48-generic"
+	assert.Error(t, c.RequireForFeatureOnKernel("tracing", "five", cap.BPF))
+
+	old := kernelRelease
+	defer func() { kernelRelease = old }()
+	kernelRelease = func() (string, error) { return "4.19.0", nil }
+	replacement, _, ok := DeprecationInfo(cap.SYS_ADMIN)
+	assert.True(t, ok)
+	assert.Equal(t, []cap.Value{cap.SYSLOG}, replacement)
+}
+
+func TestAssertRequiredEffective(t *testing.T) {
+	c := newFakeCapabilities(t, cap.IPC_LOCK)
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+
+	old := getThreadCaps
+	defer func() { getThreadCaps = old }()
+
+	thread := cap.NewSet()
+	require.NoError(t, thread.SetFlag(cap.Permitted, true, cap.IPC_LOCK))
+	require.NoError(t, thread.SetFlag(cap.Effective, true, cap.IPC_LOCK))
+	getThreadCaps = func() *cap.Set { return thread }
+
+	assert.NoError(t, c.AssertRequiredEffective())
+
+	// thread lost its elevation
+	require.NoError(t, thread.SetFlag(cap.Effective, false, cap.IPC_LOCK))
+	err := c.AssertRequiredEffective()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cap_ipc_lock")
+
+	// from within a ring callback, and concurrently with required changes
+	require.NoError(t, thread.SetFlag(cap.Effective, true, cap.IPC_LOCK))
+	c.backend = newFakeBackend(t, cap.IPC_LOCK)
+	require.NoError(t, c.Required(c.AssertRequiredEffective))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, c.AssertRequiredEffective())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, c.Unrequire(cap.IPC_LOCK))
+		require.NoError(t, c.Require(cap.IPC_LOCK))
+	}
+	<-done
+
+	c = &Capabilities{bypass: true}
+	assert.NoError(t, c.AssertRequiredEffective())
+}
+
+func TestParanoidThreshold(t *testing.T) {
+	testCases := []struct {
+		name      string
+		paranoid  int
+		threshold int
+		sysAdmin  bool
+	}{
+		{name: "default threshold, paranoid 2", paranoid: 2, threshold: 2},
+		{name: "default threshold, paranoid 3", paranoid: 3, threshold: 2, sysAdmin: true},
+		{name: "conservative threshold, paranoid 2", paranoid: 2, threshold: 1, sysAdmin: true},
+		{name: "relaxed threshold, paranoid 3", paranoid: 3, threshold: 3},
+		{name: "relaxed threshold, paranoid 4", paranoid: 4, threshold: 3, sysAdmin: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newFakeCapabilities(t)
+			ParanoidThreshold(tc.threshold)(c.opts)
+			require.NoError(t, c.RequireForFeature(FeaturePerf, cap.PERFMON))
+
+			require.NoError(t, c.requireForParanoid(tc.paranoid))
+			assert.Equal(t, tc.sysAdmin, c.all[cap.SYS_ADMIN][Required])
+		})
+	}
+
+	t.Run("perf disabled", func(t *testing.T) {
+		c := newFakeCapabilities(t)
+		require.NoError(t, c.requireForParanoid(MaxParanoiaLevel))
+		assert.False(t, c.all[cap.SYS_ADMIN][Required])
+	})
+
+	t.Run("out of range", func(t *testing.T) {
+		c := &Capabilities{}
+		err := c.initialize(false, ParanoidThreshold(5))
+		assert.EqualError(t, err, "could not use perf_event_paranoid threshold 5: must be between -1 and 4")
+	})
+}
+
+func TestPerfEventParanoidFile(t *testing.T) {
+	dir := t.TempDir()
+	paranoidFile := func(content string) string {
+		path := filepath.Join(dir, "perf_event_paranoid")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+
+	paranoid, err := getKernelPerfEventParanoidValue(paranoidFile("-1\n"))
+	require.NoError(t, err)
+	assert.Equal(t, -1, paranoid)
+
+	paranoid, err = getKernelPerfEventParanoidValue(paranoidFile("garbage\n"))
+	assert.Error(t, err)
+	assert.Equal(t, MaxParanoiaLevel, paranoid)
+
+	paranoid, err = getKernelPerfEventParanoidValue(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	assert.Equal(t, MaxParanoiaLevel, paranoid)
+
+	fakeKernelRelease(t, "5.15.0") // supporting cap.BPF
+
+	old := perfEventParanoidFile
+	defer func() { perfEventParanoidFile = old }()
+
+	for _, tc := range []struct {
+		paranoid string
+		sysAdmin bool
+	}{
+		{paranoid: "-1"},
+		{paranoid: "2"},
+		{paranoid: "4", sysAdmin: true},
+	} {
+		t.Run("paranoid "+tc.paranoid, func(t *testing.T) {
+			perfEventParanoidFile = paranoidFile(tc.paranoid + "\n")
+
+			c, _ := newFakeProcess(t, nil)
+			required := c.Info().Required
+			assert.Contains(t, required, cap.BPF)
+			assert.Contains(t, required, cap.PERFMON)
+			assert.Equal(t, tc.sysAdmin, c.all[cap.SYS_ADMIN][Required])
+		})
+	}
+}
+
+func TestParanoidLevel(t *testing.T) {
+	old := perfEventParanoidFile
+	defer func() { perfEventParanoidFile = old }()
+
+	perfEventParanoidFile = filepath.Join(t.TempDir(), "perf_event_paranoid")
+	require.NoError(t, os.WriteFile(perfEventParanoidFile, []byte("-1\n"), 0644))
+	c := &Capabilities{backend: newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)}
+	require.NoError(t, c.initialize(false))
+	assert.Equal(t, -1, c.ParanoidLevel())
+
+	perfEventParanoidFile = filepath.Join(t.TempDir(), "missing")
+	c = &Capabilities{backend: newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN)}
+	require.NoError(t, c.initialize(false))
+	assert.Equal(t, UnknownParanoiaLevel, c.ParanoidLevel())
+	assert.True(t, c.all[cap.SYS_ADMIN][Required]) // highest assumed
+
+	c = &Capabilities{}
+	require.NoError(t, c.initialize(true))
+	assert.Equal(t, UnknownParanoiaLevel, c.ParanoidLevel())
+}
+
+func TestPreferredBPFCaps(t *testing.T) {
+	oldRelease, oldParanoid, oldBound, oldThreadCaps := kernelRelease, perfEventParanoidFile, getBound, getThreadCaps
+	defer func() {
+		kernelRelease, perfEventParanoidFile, getBound, getThreadCaps = oldRelease, oldParanoid, oldBound, oldThreadCaps
+	}()
+
+	thread := cap.NewSet()
+	require.NoError(t, thread.SetFlag(cap.Permitted, true, cap.BPF, cap.PERFMON))
+	getThreadCaps = func() *cap.Set { return thread }
+
+	testCases := []struct {
+		name     string
+		release  string
+		paranoid string
+		known    bool
+		values   []cap.Value
+		reason   string
+	}{
+		{"cap_bpf", "5.15.0", "2", true, []cap.Value{cap.PERFMON, cap.BPF},
+			"kernel supports CAP_BPF (v5.8 or newer), paranoid=2 <= 2"},
+		{"paranoid", "5.15.0", "3", true, []cap.Value{cap.SYS_ADMIN, cap.PERFMON, cap.BPF},
+			"paranoid=3 > 2, cap_sys_admin not permitted"},
+		{"unknown paranoid", "5.15.0", "", true, []cap.Value{cap.SYS_ADMIN, cap.PERFMON, cap.BPF},
+			"perf_event_paranoid unknown, assuming 4 > 2, cap_sys_admin not permitted"},
+		{"backported cap_bpf", "4.18.0-305.el8.x86_64", "2", true, []cap.Value{cap.PERFMON, cap.BPF},
+			"kernel supports CAP_BPF (backported), paranoid=2 <= 2"},
+		{"no cap_bpf", "4.19.0", "2", false, []cap.Value{cap.SYS_ADMIN},
+			"kernel does not support CAP_BPF, cap_sys_admin not permitted"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			release, known := tc.release, tc.known
+			kernelRelease = func() (string, error) { return release, nil }
+			getBound = func(cap.Value) (bool, error) {
+				if !known {
+					return false, syscall.EINVAL
+				}
+				return true, nil
+			}
+			perfEventParanoidFile = filepath.Join(t.TempDir(), "perf_event_paranoid")
+			if tc.paranoid != "" {
+				require.NoError(t, os.WriteFile(perfEventParanoidFile, []byte(tc.paranoid+"\n"), 0644))
+			}
+
+			values, reason, err := PreferredBPFCaps()
+			require.NoError(t, err)
+			assert.Equal(t, tc.values, values)
+			assert.Equal(t, tc.reason, reason)
+		})
+	}
+
+	kernelRelease = func() (string, error) { return "", syscall.ENOSYS }
+	_, _, err := PreferredBPFCaps()
+	assert.ErrorIs(t, err, syscall.ENOSYS)
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	snapshot, err := Snapshot()
+	require.NoError(t, err)
+	assert.True(t, Diff(snapshot, cap.GetProc()).Empty())
+
+	a := cap.NewSet()
+	require.NoError(t, a.SetFlag(cap.Permitted, true, cap.BPF, cap.PERFMON, cap.NET_ADMIN))
+	require.NoError(t, a.SetFlag(cap.Effective, true, cap.BPF))
+	b := cap.NewSet()
+	require.NoError(t, b.SetFlag(cap.Permitted, true, cap.BPF, cap.PERFMON, cap.SYS_ADMIN))
+	require.NoError(t, b.SetFlag(cap.Inheritable, true, cap.BPF))
+
+	diff := Diff(a, b)
+	assert.Equal(t, CapFlagDiff{
+		FlagDiff:  FlagDiff{Added: []cap.Value{cap.SYS_ADMIN}, Removed: []cap.Value{cap.NET_ADMIN}},
+		Unchanged: []cap.Value{cap.PERFMON, cap.BPF},
+	}, diff.Permitted)
+	assert.Equal(t, CapFlagDiff{FlagDiff: FlagDiff{Removed: []cap.Value{cap.BPF}}}, diff.Effective)
+	assert.Equal(t, CapFlagDiff{FlagDiff: FlagDiff{Added: []cap.Value{cap.BPF}}}, diff.Inheritable)
+	assert.False(t, diff.Empty())
+
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.PERFMON, cap.BPF}, Diff(a, nil).Permitted.Removed)
+
+	oldGetPID := getPID
+	defer func() { getPID = oldGetPID }()
+	getPID = func(int) (*cap.Set, error) { return nil, syscall.ESRCH }
+	_, err = Snapshot()
+	assert.ErrorIs(t, err, syscall.ESRCH)
+}
+
+func TestDiffFromParent(t *testing.T) {
+	diff, err := diffStatus("/proc/self/status", "/proc/self/status")
+	require.NoError(t, err)
+	assert.True(t, diff.Empty())
+
+	dir := t.TempDir()
+	parent := filepath.Join(dir, "parent")
+	child := filepath.Join(dir, "child")
+	status := "CapInh:\t0000000000000000\nCapPrm:\t%016x\nCapEff:\t%016x\nCapBnd:\t%016x\n"
+	require.NoError(t, os.WriteFile(parent, []byte(fmt.Sprintf(status, 0x3, 0x3, 0x3)), 0644))
+	require.NoError(t, os.WriteFile(child, []byte(fmt.Sprintf(status, 0x6, 0x2, 0x3)), 0644))
+
+	diff, err = diffStatus(parent, child)
+	require.NoError(t, err)
+	assert.Equal(t, FlagDiff{Added: []cap.Value{2}, Removed: []cap.Value{0}}, diff.Permitted)
+	assert.Equal(t, FlagDiff{Removed: []cap.Value{0}}, diff.Effective)
+	assert.True(t, diff.Inheritable.Empty())
+	assert.True(t, diff.Bounding.Empty())
+
+	_, err = diffStatus(filepath.Join(dir, "gone"), child)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = DiffFromParent()
+	assert.NoError(t, err)
+}
+
+func TestInitDecisions(t *testing.T) {
+	c := newFakeCapabilities(t)
+	require.NoError(t, c.RequireForFeature(FeaturePerf, cap.PERFMON))
+	require.NoError(t, c.requireForParanoid(3))
+
+	expected := []Decision{
+		{
+			Point:   "paranoid",
+			Inputs:  map[string]string{"paranoid": "3", "threshold": "2"},
+			Outcome: "paranoid=3 > threshold=2, require cap_sys_admin",
+			Caps:    []cap.Value{cap.SYS_ADMIN},
+		},
+	}
+	assert.Equal(t, expected, c.InitDecisions())
+	assert.Equal(t, expected, c.Info().Decisions)
+
+	for _, e := range c.Explain() {
+		switch e.Value {
+		case cap.SYS_ADMIN:
+			assert.Equal(t, expected, e.Decisions)
+		default:
+			assert.Empty(t, e.Decisions)
+		}
+	}
+
+	t.Run("bypass", func(t *testing.T) {
+		c := &Capabilities{}
+		require.NoError(t, c.initialize(true))
+		decisions := c.Info().Decisions
+		require.Len(t, decisions, 1)
+		assert.Equal(t, "bypass", decisions[0].Point)
+		assert.Equal(t, "bypass", decisions[0].Outcome)
+		assert.Equal(t, "true", decisions[0].Inputs["bypass"])
+	})
+
+	t.Run("initialize", func(t *testing.T) {
+		c, _ := newFakeProcess(t, nil)
+		var points []string
+		for _, d := range c.InitDecisions() {
+			points = append(points, d.Point)
+		}
+		assert.Equal(t, []string{"bypass", "kernel", "base", "strategy", "feature", "feature", "paranoid"}, points)
+	})
+}
+
+func TestGetProcRetries(t *testing.T) {
+	oldGetPID, oldDelay := getPID, getProcRetryDelay
+	defer func() { getPID, getProcRetryDelay = oldGetPID, oldDelay }()
+	getProcRetryDelay = 0
+
+	failing := func(failures int, err error) *int {
+		calls := 0
+		getPID = func(pid int) (*cap.Set, error) {
+			calls++
+			if calls <= failures {
+				return nil, err
+			}
+			return cap.NewSet(), nil
+		}
+		return &calls
+	}
+
+	c := newFakeCapabilities(t)
+
+	calls := failing(2, syscall.EAGAIN)
+	assert.NoError(t, c.getProc())
+	assert.Equal(t, 3, *calls)
+
+	calls = failing(3, syscall.EAGAIN)
+	assert.ErrorIs(t, c.getProc(), syscall.EAGAIN)
+	assert.Equal(t, 3, *calls)
+
+	calls = failing(1, syscall.EINVAL) // permanent
+	assert.Error(t, c.getProc())
+	assert.Equal(t, 1, *calls)
+
+	GetProcRetries(0)(c.opts)
+	calls = failing(1, syscall.EINTR)
+	assert.Error(t, c.getProc())
+	assert.Equal(t, 1, *calls)
+}
+
+// flakyBackend is a fake backend failing to set the process capabilities a
+// given number of times.
+type flakyBackend struct {
+	*fakeBackend
+	failures int
+	err      error
+	calls    int
+}
+
+func (b *flakyBackend) SetProc(set *cap.Set) error {
+	b.calls++
+	if b.calls <= b.failures {
+		return b.err
+	}
+
+	return b.fakeBackend.SetProc(set)
+}
+
+func TestSetProcRetries(t *testing.T) {
+	oldDelay := setProcRetryDelay
+	defer func() { setProcRetryDelay = oldDelay }()
+	setProcRetryDelay = 0
+
+	b := &flakyBackend{fakeBackend: newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)}
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	failing := func(failures int, err error) {
+		b.calls, b.failures, b.err = 0, failures, err
+		c.stale = false
+	}
+
+	failing(3, syscall.EAGAIN)
+	assert.NoError(t, c.setProc())
+	assert.Equal(t, 4, b.calls)
+
+	failing(4, syscall.EAGAIN)
+	err := c.setProc()
+	assert.ErrorIs(t, err, syscall.EAGAIN)
+	assert.Equal(t, 4, b.calls)
+	assert.True(t, c.stale)
+
+	failing(1, syscall.EPERM) // denied
+	assert.ErrorIs(t, c.setProc(), syscall.EPERM)
+	assert.Equal(t, 1, b.calls)
+
+	SetProcRetries(0)(c.opts)
+	failing(1, syscall.EINTR)
+	assert.Error(t, c.setProc())
+	assert.Equal(t, 1, b.calls)
+}
+
+func TestRequestedBestEffort(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+	missing := cap.MaxBits()
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		if permitted, _ := c.have.GetFlag(cap.Permitted, v); !permitted {
+			missing = v
+			break
+		}
+	}
+	if missing == cap.MaxBits() {
+		t.Skip("all capabilities are permitted")
+	}
+
+	var granted []cap.Value
+	err := c.RequestedBestEffort(func(g []cap.Value) error {
+		granted = g
+		assert.Contains(t, b.effective(), cap.NET_ADMIN)
+		return nil
+	}, cap.NET_ADMIN, missing)
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, granted)
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+
+	c = &Capabilities{bypass: true}
+	err = c.RequestedBestEffort(func(g []cap.Value) error {
+		granted = g
+		return nil
+	}, cap.NET_ADMIN, missing)
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, missing}, granted)
+}
+
+func TestMaxQueuedElevations(t *testing.T) {
+	c, _ := newFakeProcess(t, nil)
+	MaxQueuedElevations(1)(c.opts)
+
+	c.lock.Lock() // another elevated ring is running
+
+	done := make(chan error)
+	go func() {
+		done <- c.Required(func() error { return nil })
+	}()
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&c.waiting) == 1
+	}, time.Second, time.Millisecond)
+
+	start := time.Now()
+	err := c.Privileged(func() error { return nil })
+	assert.ErrorIs(t, err, ErrTooManyElevations)
+	assert.Less(t, time.Since(start), time.Second)
+
+	c.lock.Unlock()
+	assert.NoError(t, <-done)
+	assert.Zero(t, atomic.LoadInt32(&c.waiting))
+
+	err = (&Capabilities{}).initialize(false, MaxQueuedElevations(-1))
+	assert.EqualError(t, err, "could not use maximum queued elevations -1: must not be negative")
+}
+
+func TestPrivilegedTimeBudget(t *testing.T) {
+	c := newFakeCapabilities(t)
+	assert.Nil(t, c.Info().PrivilegedBudget)
+
+	PrivilegedTimeBudget(time.Second)(c.opts)
+	c.countTransition(Privileged, nil)
+	c.counters.since = c.counters.since.Add(-600 * time.Millisecond)
+	c.countTransition(Unprivileged, nil)
+
+	remaining := c.Info().PrivilegedBudget
+	require.NotNil(t, remaining)
+	assert.InDelta(t, 400*time.Millisecond, *remaining, float64(100*time.Millisecond))
+	assert.NoError(t, c.checkPrivilegedBudget())
+
+	c.counters.timeInRing[Privileged] = 2 * time.Second // budget spent
+	assert.Equal(t, time.Duration(0), *c.Info().PrivilegedBudget)
+
+	logs := captureLogs(t)
+	assert.NoError(t, c.checkPrivilegedBudget())
+	assert.Contains(t, logs.String(), "privileged time budget exceeded")
+
+	PrivilegedBudgetFail(true)(c.opts)
+	err := c.Privileged(func() error {
+		t.Fatal("callback must not run")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrPrivilegedBudgetExceeded)
+}
+
+func TestPrivilegedGuarded(t *testing.T) {
+	run := func(t *testing.T, c *Capabilities) {
+		var extLock sync.Mutex
+		var wg sync.WaitGroup
+
+		shared := 0
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				err := c.PrivilegedGuarded(&extLock, func() error {
+					shared++
+					return nil
+				})
+				assert.NoError(t, err)
+			}()
+			go func() {
+				defer wg.Done()
+				extLock.Lock()
+				shared++
+				extLock.Unlock()
+				assert.NoError(t, c.Requested(func() error { return nil }))
+			}()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("deadlock")
+		}
+		assert.Equal(t, 20, shared)
+	}
+
+	t.Run("bypass", func(t *testing.T) {
+		run(t, &Capabilities{bypass: true})
+	})
+
+	t.Run("privileged", func(t *testing.T) {
+		c, _ := newFakeProcess(t, allValues())
+		run(t, c)
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	old := getBound
+	defer func() { getBound = old }()
+
+	last := cap.MaxBits() - 1
+	getBound = func(v cap.Value) (bool, error) {
+		if v == last {
+			return false, syscall.EINVAL // unknown to the (simulated) kernel
+		}
+		return true, nil
+	}
+
+	c := newFakeCapabilities(t)
+	logs := captureLogs(t)
+	c.reconcile()
+
+	assert.NotContains(t, c.all, last)
+	assert.Len(t, c.all, int(cap.MaxBits())-1)
+	assert.Contains(t, logs.String(), "capabilities not supported by the kernel")
+	assert.Contains(t, logs.String(), last.String())
+
+	assert.EqualError(t, c.Require(last), "could not find capability: "+last.String())
+	assert.NoError(t, c.Unrequire(last))
+	assert.NotContains(t, c.ring(Privileged), last)
+}
+
+func TestWithFeatureCaps(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW})
+
+	missing := cap.MaxBits()
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		if permitted, _ := c.have.GetFlag(cap.Permitted, v); !permitted {
+			missing = v
+			break
+		}
+	}
+	values := []cap.Value{cap.NET_ADMIN, cap.NET_RAW}
+	if missing != cap.MaxBits() {
+		values = append(values, missing)
+	}
+
+	for i := 0; i < 2; i++ { // registered only once
+		err := c.WithFeatureCaps("network", values, func(granted []cap.Value) error {
+			assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW}, granted)
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			assert.Contains(t, b.effective(), cap.NET_RAW)
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW}, c.Info().Features["network"])
+
+	for _, e := range c.Explain() {
+		if e.Value == cap.NET_ADMIN {
+			assert.Contains(t, e.Reasons, "feature: network")
+		}
+	}
+}
+
+func TestWarnExcessPermitted(t *testing.T) {
+	c := newFakeCapabilities(t, cap.BPF, cap.PERFMON, cap.IPC_LOCK, cap.SYS_ADMIN, cap.NET_RAW)
+	c.hasBPF = true
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK, cap.PERFMON, cap.BPF}, c.AllPotentialCaps())
+
+	logs := captureLogs(t)
+	c.adviseExcessPermitted()
+	assert.Contains(t, logs.String(), "consider narrowing the securityContext to [cap_ipc_lock cap_perfmon cap_bpf]")
+	assert.Contains(t, logs.String(), `"excess":["cap_net_raw","cap_sys_admin"]`)
+
+	c = newFakeCapabilities(t, cap.BPF, cap.IPC_LOCK)
+	c.hasBPF = true
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+	logs = captureLogs(t)
+	c.adviseExcessPermitted()
+	assert.NotContains(t, logs.String(), "more capabilities than it needs")
+}
+
+func TestRingsCtx(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "value")
+
+	err := c.RequestedCtx(ctx, func(ctx context.Context) error {
+		assert.Equal(t, "value", ctx.Value(key{}))
+		assert.Contains(t, b.effective(), cap.NET_ADMIN)
+		return nil
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+
+	err = c.RequiredCtx(ctx, func(ctx context.Context) error {
+		assert.Equal(t, "value", ctx.Value(key{}))
+		return nil
+	})
+	require.NoError(t, err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	cb := func(context.Context) error {
+		t.Fatal("callback must not run")
+		return nil
+	}
+	assert.ErrorIs(t, c.PrivilegedCtx(cancelled, cb), context.Canceled)
+	assert.ErrorIs(t, c.RequiredCtx(cancelled, cb), context.Canceled)
+	assert.ErrorIs(t, c.RequestedCtx(cancelled, cb, cap.NET_ADMIN), context.Canceled)
+	assert.Empty(t, events) // no ring change
+}
+
+func TestNestedRings(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.IPC_LOCK, cap.NET_ADMIN})
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	err := c.Required(func() error {
+		err := c.Requested(func() error {
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			assert.NotContains(t, b.effective(), cap.IPC_LOCK)
+
+			return c.Required(func() error {
+				assert.Contains(t, b.effective(), cap.IPC_LOCK)
+				return nil
+			})
+		}, cap.NET_ADMIN)
+		require.NoError(t, err)
+
+		// the inner rings restored the outer one
+		assert.Contains(t, b.effective(), cap.IPC_LOCK)
+		assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+		assert.Len(t, c.frames, 1)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	assert.NotContains(t, b.effective(), cap.IPC_LOCK)
+	assert.Empty(t, c.frames)
+	assert.Zero(t, c.owner)
+
+	var rings []Ring
+	for len(events) > 0 {
+		rings = append(rings, (<-events).To)
+	}
+	assert.Equal(t, []Ring{Required, Requested, Required, Requested, Required, Unprivileged}, rings)
+
+	// the lock was released
+	assert.NoError(t, c.Required(func() error { return nil }))
+}
+
+func TestRingPanic(t *testing.T) {
+	c, b := newFakeProcess(t, allValues())
+
+	assert.PanicsWithValue(t, "boom", func() {
+		_ = c.Requested(func() error {
+			assert.Contains(t, b.effective(), cap.NET_ADMIN)
+			panic("boom")
+		}, cap.NET_ADMIN)
+	})
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+	assert.Equal(t, Unprivileged, c.current)
+
+	// nested: the outer ring is restored while the panic goes through it
+	assert.Panics(t, func() {
+		_ = c.Required(func() error {
+			return c.Requested(func() error {
+				panic("boom")
+			}, cap.NET_ADMIN)
+		})
+	})
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+	assert.Empty(t, c.frames)
+
+	// the lock was released (from another goroutine, so it is not reentrant)
+	done := make(chan error)
+	go func() {
+		done <- c.Requested(func() error { return nil }, cap.NET_ADMIN)
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not released")
+	}
+
+	assert.Panics(t, func() {
+		_ = c.Privileged(func() error { panic("boom") })
+	})
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+}
+
+func TestEffectiveRing(t *testing.T) {
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+
+	err := c.Required(func() error {
+		assert.Equal(t, Required, c.EffectiveRing())
+		return c.Requested(func() error {
+			assert.Equal(t, Requested, c.EffectiveRing())
+			return nil
+		}, cap.NET_ADMIN)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+	assert.Equal(t, "unprivileged", c.EffectiveRing().String())
+
+	assert.False(t, c.IsBypass())
+
+	bypassed := &Capabilities{}
+	require.NoError(t, bypassed.initialize(true))
+	assert.True(t, bypassed.IsBypass())
+	assert.Equal(t, Privileged, bypassed.EffectiveRing())
+}
+
+func TestKeepBounded(t *testing.T) {
+	_, b := newFakeProcess(t, nil, KeepBounded(cap.NET_ADMIN, cap.SETUID))
+	assert.True(t, b.bound[cap.NET_ADMIN])
+	assert.True(t, b.bound[cap.SETUID])
+	assert.False(t, b.bound[cap.NET_RAW])
+	assert.False(t, b.bound[cap.SYS_ADMIN])
+}
+
+func TestCheckRequiredPermitted(t *testing.T) {
+	c := newFakeCapabilities(t, cap.BPF, cap.PERFMON)
+	require.NoError(t, c.Require(cap.BPF, cap.PERFMON))
+	assert.NoError(t, c.checkRequiredPermitted())
+
+	require.NoError(t, c.Require(cap.SYS_ADMIN, cap.IPC_LOCK))
+	err := c.checkRequiredPermitted()
+	assert.ErrorIs(t, err, ErrRequiredNotPermitted)
+	assert.Contains(t, err.Error(), "[cap_ipc_lock cap_sys_admin]")
+}
+
+func TestValidate(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, BaseRequired(cap.NET_ADMIN))) // checked later
+	err := c.Validate()
+	assert.ErrorIs(t, err, ErrRequiredNotPermitted)
+	assert.Contains(t, err.Error(), "[cap_net_admin]")
+
+	require.NoError(t, c.ForceUnrequire(cap.NET_ADMIN)) // --capabilities drop=
+	assert.NoError(t, c.Validate())
+
+	assert.NoError(t, (&Capabilities{bypass: true}).Validate())
+}
+
+func TestRestore(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+	before := stateOf(c.original)
+
+	oldCaps := caps
+	defer func() { caps = oldCaps }()
+	caps = c
+
+	require.NoError(t, c.Restore())
+	assert.Equal(t, before, stateOf(b.set))
+	assert.Contains(t, b.effective(), cap.NET_ADMIN)
+	assert.Nil(t, caps)
+
+	require.NoError(t, c.Restore()) // idempotent
+
+	bypassed := &Capabilities{}
+	require.NoError(t, bypassed.initialize(true))
+	assert.NoError(t, bypassed.Restore())
+}
+
+func TestCachedProc(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+	counting := &countingBackend{fakeBackend: b}
+	c.backend = counting
+
+	cb := func() error { return nil }
+	require.NoError(t, c.Requested(cb, cap.NET_ADMIN))
+	assert.Zero(t, counting.reads, "transitions should not read the process capabilities")
+
+	// the cached capabilities no longer match the process ones
+	require.NoError(t, c.have.SetFlag(cap.Permitted, true, cap.NET_RAW))
+
+	require.NoError(t, c.Requested(cb, cap.NET_ADMIN))
+	assert.Equal(t, 1, counting.reads)
+	assert.NotContains(t, stateOf(b.set).Permitted, cap.NET_RAW)
+}
+
+// countingBackend is a fake backend counting the reads of the process
+// capabilities.
+type countingBackend struct {
+	*fakeBackend
+	reads int
+}
+
+func (b *countingBackend) GetProc() (*cap.Set, error) {
+	b.reads++
+	return b.fakeBackend.GetProc()
+}
+
+// BenchmarkTransitions measures ring transitions using the cached process
+// capabilities, and reading them on every transition (as it used to be done).
+func BenchmarkTransitions(b *testing.B) {
+	c, _ := newFakeProcess(b, []cap.Value{cap.NET_ADMIN})
+
+	cb := func() error { return nil }
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_ = c.Requested(cb, cap.NET_ADMIN)
+		}
+	})
+
+	b.Run("uncached", func(b *testing.B) {
+		c.onSetProc = func(CapState) { c.stale = true }
+		defer func() { c.onSetProc = nil }()
+
+		for i := 0; i < b.N; i++ {
+			_ = c.Requested(cb, cap.NET_ADMIN)
+		}
+	})
+}
+
+func TestSetEffective(t *testing.T) {
+	logs := captureLogs(t)
+	c := newFakeCapabilities(t, cap.NET_ADMIN, cap.NET_RAW, cap.SYSLOG)
+	require.NoError(t, c.have.SetFlag(cap.Effective, true, cap.NET_RAW, cap.SYSLOG))
+
+	on := map[cap.Value]bool{cap.NET_ADMIN: true, cap.SYSLOG: true}
+	raised, lowered, err := c.setEffective(func(v cap.Value) bool { return on[v] })
+	require.NoError(t, err)
+	sortValues(raised)
+	sortValues(lowered)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, raised)
+	assert.Equal(t, []cap.Value{cap.NET_RAW}, lowered)
+
+	// only changes are logged
+	assert.Equal(t, 1, strings.Count(logs.String(), `"enabling"`))
+	assert.Equal(t, 1, strings.Count(logs.String(), `"disabling"`))
+
+	// same as setting the flags one capability at a time
+	expected := cap.NewSet()
+	require.NoError(t, expected.SetFlag(cap.Permitted, true, cap.NET_ADMIN, cap.NET_RAW, cap.SYSLOG))
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		require.NoError(t, expected.SetFlag(cap.Effective, on[v], v))
+	}
+	cf, err := expected.Cf(c.have)
+	require.NoError(t, err)
+	assert.Zero(t, cf)
+}
+
+func TestGetEffective(t *testing.T) {
+	c := newFakeCapabilities(t, cap.NET_RAW, cap.NET_ADMIN, cap.SYSLOG)
+	require.NoError(t, c.have.SetFlag(cap.Effective, true, cap.SYSLOG, cap.NET_RAW))
+
+	effective, err := c.GetEffective()
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_RAW, cap.SYSLOG}, effective)
+
+	permitted, err := c.GetPermitted()
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW, cap.SYSLOG}, permitted)
+
+	t.Run("within a ring", func(t *testing.T) {
+		c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+		err := c.Requested(func() error {
+			effective, err := c.GetEffective()
+			assert.Equal(t, []cap.Value{cap.NET_ADMIN}, effective)
+			return err
+		}, cap.NET_ADMIN)
+		require.NoError(t, err)
+	})
+}
+
+func TestDumpState(t *testing.T) {
+	c := newFakeCapabilities(t, cap.BPF, cap.PERFMON)
+	c.paranoid = 2
+	require.NoError(t, c.Require(cap.BPF))
+	require.NoError(t, c.have.SetFlag(cap.Effective, true, cap.BPF))
+
+	data, err := c.DumpState()
+	require.NoError(t, err)
+
+	again, err := c.DumpState()
+	require.NoError(t, err)
+	assert.Equal(t, data, again) // stable
+
+	var dump stateDump
+	require.NoError(t, json.Unmarshal(data, &dump))
+	assert.Equal(t, 2, dump.Paranoid)
+	assert.Len(t, dump.Caps, int(cap.MaxBits()))
+	assert.Equal(t, capState{Privileged: true, Required: true, Permitted: true, Effective: true}, dump.Caps["cap_bpf"])
+	assert.Equal(t, capState{Privileged: true, Permitted: true}, dump.Caps["cap_perfmon"])
+	assert.Equal(t, capState{Privileged: true}, dump.Caps["cap_sys_admin"])
+}
+
+func TestReqByString(t *testing.T) {
+	for _, given := range []string{"cap_sys_ptrace", "CAP_SYS_PTRACE", "sys_ptrace", "Cap_Sys_Ptrace"} {
+		values, err := ReqByString(given)
+		require.NoError(t, err, given)
+		assert.Equal(t, []cap.Value{cap.SYS_PTRACE}, values, given)
+	}
+
+	values, err := ReqByString("BPF") // not the group
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.BPF}, values)
+
+	values, err = ReqByString("GROUP:BPF")
+	require.NoError(t, err)
+	assert.Equal(t, Groups["bpf"], values)
+
+	values, err = ReqByString("CAP_BPF")
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.BPF}, values)
+
+	_, err = ReqByString("CAP_SYS_NOTHING")
+	assert.EqualError(t, err, "could not find capability: CAP_SYS_NOTHING")
+}
+
+func TestNameOfValueOf(t *testing.T) {
+	assert.Equal(t, "cap_bpf", NameOf(cap.BPF))
+	assert.Equal(t, cap.MaxBits().String(), NameOf(cap.MaxBits()))
+
+	for _, name := range []string{"cap_sys_admin", "CAP_SYS_ADMIN", "sys_admin"} {
+		v, ok := ValueOf(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, cap.SYS_ADMIN, v, name)
+	}
+	_, ok := ValueOf("cap_unknown")
+	assert.False(t, ok)
+
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		got, ok := ValueOf(NameOf(v))
+		require.True(t, ok)
+		require.Equal(t, v, got)
+	}
+}
+
+func TestReqByStringUnknown(t *testing.T) {
+	_, err := ReqByString("cap_kill", "cap_nothing", "group:net", "NOTHING_ELSE")
+	assert.EqualError(t, err, "could not find capabilities: cap_nothing, NOTHING_ELSE")
+
+	avail := ListAvailCaps()
+	require.Len(t, avail, int(cap.MaxBits()))
+	assert.Equal(t, "cap_chown", avail[cap.CHOWN])
+	avail[0] = "changed"
+	assert.Equal(t, "cap_chown", ListAvailCaps()[0])
+}
+
+func TestRequiredWith(t *testing.T) {
+	c, b := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+	require.NoError(t, c.Unrequire(cap.NET_ADMIN))
+
+	required := c.Info().Required
+	err := c.RequiredWith(func() error {
+		effective, err := c.GetEffective()
+		assert.Equal(t, len(required)+1, len(effective))
+		assert.Subset(t, effective, required)
+		assert.Contains(t, effective, cap.NET_ADMIN)
+		assert.Equal(t, Required, c.EffectiveRing())
+		return err
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+
+	assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+	assert.NotContains(t, c.Info().Required, cap.NET_ADMIN)
+}
+
+func TestListRequired(t *testing.T) {
+	c := newFakeCapabilities(t)
+	require.NoError(t, c.Require(cap.SYSLOG, cap.BPF, cap.NET_ADMIN))
+	require.NoError(t, c.Unrequire(cap.BPF))
+
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.SYSLOG}, c.ListRequired())
+	assert.True(t, c.IsRequired(cap.SYSLOG))
+	assert.False(t, c.IsRequired(cap.BPF))
+
+	require.NoError(t, c.Require(cap.BPF))
+	assert.True(t, c.IsRequired(cap.BPF))
+
+	c = &Capabilities{bypass: true}
+	assert.Empty(t, c.ListRequired())
+	assert.False(t, c.IsRequired(cap.BPF))
+}
+
+func TestBPFSupport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		release  string
+		known    bool // cap.BPF known by the kernel
+		expected bool
+		support  string
+	}{
+		{name: "v5.8", release: "5.8.0-63-generic", known: true, expected: true, support: "v5.8 or newer"},
+		{name: "newer", release: "6.1.0", known: true, expected: true, support: "v5.8 or newer"},
+		{name: "backported", release: "4.18.0-305.12.1.el8_4.x86_64", known: true, expected: true, support: "backported"},
+		{name: "older", release: "5.4.0-100-generic", support: "none"},
+		{name: "unknown release", release: "", support: "none"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newFakeCapabilities(t)
+			c.release = tc.release
+			if !tc.known {
+				delete(c.all, cap.BPF)
+			}
+			supported, support := c.bpfSupport()
+			assert.Equal(t, tc.expected, supported)
+			assert.Equal(t, tc.support, support)
+		})
+	}
+}
+
+// restrictedBackend is a fake backend of a restricted container, where neither
+// the process capabilities nor the bounding set can be changed.
+type restrictedBackend struct {
+	*fakeBackend
+}
+
+func (b restrictedBackend) SetProc(*cap.Set) error {
+	return errors.New("operation not permitted")
+}
+
+func (b restrictedBackend) DropBound(...cap.Value) error {
+	return errors.New("operation not permitted")
+}
+
+func TestInitializeBestEffort(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+
+	c := &Capabilities{backend: restrictedBackend{b}}
+	logs := captureLogs(t)
+	errs := c.initializeBestEffort(false)
+	require.NotEmpty(t, errs)
+	assert.Contains(t, errs[0].Error(), "bounding set")
+	assert.Equal(t, 1, strings.Count(logs.String(), "could not drop capabilities from bounding set")) // not one per capability
+	assert.Contains(t, errs[len(errs)-1].Error(), "operation not permitted")
+	assert.True(t, c.Info().Degraded)
+
+	called := false
+	err := c.Required(func() error {
+		called = true
+		return nil
+	})
+	require.NoError(t, err)
+	assert.True(t, called)
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.PERFMON, cap.BPF}, b.effective()) // untouched
+
+	c = &Capabilities{backend: newFakeBackend(t, cap.IPC_LOCK)}
+	errs = c.initializeBestEffort(false)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrRequiredNotPermitted) // not fatal
+	assert.False(t, c.Info().Degraded)
+}
+
+func TestDryRun(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+
+	c := &Capabilities{backend: restrictedBackend{b}}
+	require.NoError(t, c.initialize(false, DryRun(true)))
+	assert.True(t, b.bound[cap.NET_ADMIN])
+
+	err := c.Required(func() error {
+		assert.Equal(t, Required, c.EffectiveRing())
+		effective, err := c.GetEffective()
+		assert.Equal(t, c.ring(Required), effective) // what would have been applied
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+	assert.Zero(t, c.Stats().SetProcs)
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.PERFMON, cap.BPF}, b.effective()) // untouched
+
+	oldNoNewPrivs := setNoNewPrivs
+	defer func() { setNoNewPrivs = oldNoNewPrivs }()
+	setNoNewPrivs = func() error {
+		t.Error("no_new_privs set in a dry run")
+		return nil
+	}
+	ambient := fakeAmbient(t)
+
+	c = &Capabilities{backend: restrictedBackend{b}}
+	require.NoError(t, c.initialize(false, DryRun(true), NoNewPrivs(true)))
+	require.NoError(t, c.EnableNoNewPrivs())
+	require.NoError(t, c.SetAmbient(cap.PERFMON))
+	assert.Empty(t, ambient)
+	assert.Empty(t, stateOf(b.set).Inheritable)
+	assert.Zero(t, c.Stats().SetProcs)
+}
+
+func TestNotInitialized(t *testing.T) {
+	var none *Capabilities
+	noop := func() error { return nil }
+	granted := func([]cap.Value) error { return nil }
+	ctx := context.Background()
+	ctxNoop := func(context.Context) error { return nil }
+	set, err := PrepareCapSet("cap_net_admin")
+	require.NoError(t, err)
+
+	for _, c := range []*Capabilities{none, {}} {
+		// methods failing with ErrNotInitialized
+
+		errs := map[string]error{
+			"Restore":                   c.Restore(),
+			"Privileged":                c.Privileged(noop),
+			"PrivilegedCtx":             c.PrivilegedCtx(ctx, ctxNoop),
+			"PrivilegedAllThreads":      c.PrivilegedAllThreads(noop),
+			"PrivilegedGuarded":         c.PrivilegedGuarded(&sync.Mutex{}, noop),
+			"Required":                  c.Required(noop),
+			"RequiredCtx":               c.RequiredCtx(ctx, ctxNoop),
+			"RequiredDeadline":          c.RequiredDeadline(ctx, noop),
+			"RequiredWith":              c.RequiredWith(noop, cap.NET_ADMIN),
+			"Requested":                 c.Requested(noop, cap.NET_ADMIN),
+			"RequestedCtx":              c.RequestedCtx(ctx, ctxNoop, cap.NET_ADMIN),
+			"RequestedBestEffort":       c.RequestedBestEffort(granted, cap.NET_ADMIN),
+			"WithFeatureCaps":           c.WithFeatureCaps("feature", []cap.Value{cap.NET_ADMIN}, granted),
+			"RequestedByName":           c.RequestedByName(noop, "cap_net_admin"),
+			"RequestedSet":              c.RequestedSet(noop, set),
+			"RequestedBatch":            c.RequestedBatch([]RequestedOp{{Callback: noop, Values: []cap.Value{cap.NET_ADMIN}}}),
+			"DropTemporarily":           c.DropTemporarily(noop),
+			"Require":                   c.Require(cap.NET_ADMIN),
+			"RequireForFeature":         c.RequireForFeature("feature", cap.NET_ADMIN),
+			"RequireForFeatureOnKernel": c.RequireForFeatureOnKernel("feature", "5.8", cap.NET_ADMIN),
+			"ForFeature":                c.ForFeature(FeatureBPF, noop),
+			"Unrequire":                 c.Unrequire(cap.NET_ADMIN),
+			"ForceUnrequire":            c.ForceUnrequire(cap.NET_ADMIN),
+			"Confine":                   c.Confine(Required, cap.NET_ADMIN),
+			"Unconfine":                 c.Unconfine(Required),
+			"AssertRequiredEffective":   c.AssertRequiredEffective(),
+			"Validate":                  c.Validate(),
+			"DumpStateToFile":           c.DumpStateToFile(filepath.Join(t.TempDir(), "state.json")),
+			"RequireForPhase":           c.RequireForPhase("phase", cap.NET_ADMIN),
+			"BeginPhase":                c.BeginPhase("phase"),
+			"EndPhase":                  c.EndPhase("phase"),
+			"RequireForProgramTypes":    c.RequireForProgramTypes("kprobe"),
+			"RegisterRequirement":       c.RegisterRequirement("feature", cap.NET_ADMIN),
+			"EnableNoNewPrivs":          c.EnableNoNewPrivs(),
+			"LockDown":                  c.LockDown(),
+			"SetAmbient":                c.SetAmbient(cap.NET_ADMIN),
+			"SetInheritable":            c.SetInheritable(cap.NET_ADMIN),
+			"WriteMetrics":              c.WriteMetrics(&bytes.Buffer{}),
+		}
+		_, errs["EnterRequested"] = c.EnterRequested(cap.NET_ADMIN)
+		_, errs["TransitionTo"] = c.TransitionTo(Required)
+		_, errs["GetEffective"] = c.GetEffective()
+		_, errs["GetPermitted"] = c.GetPermitted()
+		_, errs["HasEffective"] = c.HasEffective(cap.NET_ADMIN)
+		_, errs["DetectDrift"] = c.DetectDrift()
+		_, errs["DumpState"] = c.DumpState()
+		_, errs["UnregisterRequirement"] = c.UnregisterRequirement("feature")
+		_, errs["PrivilegedValue"] = PrivilegedValue(c, func() (int, error) { return 0, nil })
+		for method, err := range errs {
+			assert.ErrorIs(t, err, ErrNotInitialized, method)
+		}
+
+		// methods returning their documented zero value
+
+		assert.NotPanics(t, func() {
+			c.Seal()
+			c.SetAuditWriter(&bytes.Buffer{})
+			c.SetPrivilegedWatchdog(time.Second)
+			c.SetRingChangeHook(func(Ring, Ring) {})
+			c.SetMetrics(nil)
+		})
+		assert.Nil(t, c.Explain())
+		assert.Nil(t, c.SimulateDrop(cap.BPF))
+		assert.Nil(t, c.AllPotentialCaps())
+		ok, missing := c.CanEnter(Required)
+		assert.False(t, ok)
+		assert.Nil(t, missing)
+		assert.False(t, c.IsBypass())
+		assert.Equal(t, Unprivileged, c.EffectiveRing())
+		assert.Nil(t, c.ListRequired())
+		assert.False(t, c.IsRequired(cap.BPF))
+		assert.Equal(t, UnknownParanoiaLevel, c.ParanoidLevel())
+		assert.Equal(t, Info{}, c.Info())
+		assert.Nil(t, c.InitDecisions())
+		assert.Empty(t, c.RenderDOT())
+		assert.Nil(t, c.RequirementsFor("feature"))
+		assert.Empty(t, c.Stats().Transitions)
+		events, unsubscribe := c.Subscribe()
+		_, open := <-events
+		assert.False(t, open)
+		unsubscribe()
+	}
+
+	c := &Capabilities{}
+	require.NoError(t, c.initialize(true))
+	assert.NoError(t, c.Privileged(noop))
+}
+
+func TestMaxBitsBoundary(t *testing.T) {
+	last := cap.MaxBits() - 1
+	noop := func() error { return nil }
+
+	c := newFakeCapabilities(t, last)
+	c.backend = newFakeBackend(t, last)
+	require.NoError(t, c.Require(last))
+	assert.Equal(t, []cap.Value{last}, c.ListRequired())
+	assert.NoError(t, c.Requested(noop, last))
+	require.NoError(t, c.Unrequire(last))
+
+	assert.ErrorContains(t, c.Require(cap.MaxBits()), "out of range")
+
+	delete(c.all, last) // known to libcap, but not when initialized
+	require.NoError(t, c.Require(last))
+	assert.Equal(t, []cap.Value{last}, c.ListRequired())
+	require.NoError(t, c.Unrequire(last))
+	delete(c.all, last)
+	require.NoError(t, c.Unrequire(last))
+	assert.Empty(t, c.ListRequired())
+
+	delete(c.all, last)
+	c.unsupported = map[cap.Value]bool{last: true} // not supported by the kernel (see reconcile)
+	assert.ErrorContains(t, c.Require(last), "could not find capability")
+	assert.Error(t, c.Requested(noop, last))
+	assert.NoError(t, c.Unrequire(last))
+	assert.NoError(t, c.ForceUnrequire(last))
+}
+
+func TestInvalidValues(t *testing.T) {
+	c := newFakeCapabilities(t, cap.NET_ADMIN)
+	noop := func() error { return nil }
+
+	for _, v := range []cap.Value{cap.Value(9999), cap.MaxBits()} {
+		err := c.Require(v)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "out of range")
+		assert.Error(t, c.Unrequire(v))
+		assert.Error(t, c.Requested(noop, v))
+	}
+	assert.Empty(t, c.ring(Required))
+	assert.Empty(t, c.ring(Requested))
+}
+
+func TestSetPrivilegedWatchdog(t *testing.T) {
+	var all []cap.Value
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		all = append(all, v)
+	}
+	c := &Capabilities{backend: newFakeBackend(t, all...)}
+	require.NoError(t, c.initialize(false))
+	logs := captureLogs(t)
+
+	c.SetPrivilegedWatchdog(10 * time.Millisecond)
+	require.NoError(t, c.Privileged(func() error { return nil }))
+	require.NoError(t, c.Required(func() error {
+		time.Sleep(50 * time.Millisecond) // not watched
+		return nil
+	}))
+	assert.NotContains(t, logs.String(), "exceeded its watchdog")
+
+	err := c.Privileged(func() error {
+		time.Sleep(50 * time.Millisecond) // warning is logged meanwhile
+		assert.Equal(t, Privileged, c.EffectiveRing())
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), "privileged ring callback exceeded its watchdog")
+	assert.Contains(t, logs.String(), "TestSetPrivilegedWatchdog")
+
+	c.SetPrivilegedWatchdog(0)
+	logs = captureLogs(t)
+	require.NoError(t, c.Privileged(func() error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}))
+	assert.NotContains(t, logs.String(), "exceeded its watchdog")
+}
+
+func TestBaseRequired(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, NoDefaultBase(true), BaseRequired(cap.NET_ADMIN), Features()))
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, c.ring(Required))
+	assert.Equal(t, "require cap_net_admin", c.decisions[2].Outcome)
+
+	c = &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, BaseRequired(cap.NET_ADMIN), Features(FeatureBPF)))
+	assert.ElementsMatch(t, []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.NET_ADMIN, cap.BPF}, c.ring(Required))
+
+	c = &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, NoDefaultBase(true), Features()))
+	assert.Empty(t, c.ring(Required))
+	assert.Equal(t, "no base requirement", c.decisions[2].Outcome)
+
+	c = &Capabilities{backend: b}
+	assert.Error(t, c.initialize(false, BaseRequired(cap.Value(9999))))
+}
+
+func TestTransitionTo(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, Features(FeatureBPF)))
+
+	event, err := c.TransitionTo(Required)
+	require.NoError(t, err)
+	assert.Equal(t, Unprivileged, event.From)
+	assert.Equal(t, Required, event.To)
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF}, event.Raised)
+	assert.Empty(t, event.Lowered)
+	assert.Equal(t, Required, c.EffectiveRing())
+
+	event, err = c.TransitionTo(Unprivileged)
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF}, event.Lowered)
+	assert.Empty(t, b.effective())
+
+	err = c.Required(func() error {
+		_, err := c.TransitionTo(Privileged)
+		return err
+	})
+	assert.ErrorContains(t, err, "ring callback")
+}
+
+func TestDetectDrift(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	logs := captureLogs(t)
+
+	drift, err := c.DetectDrift()
+	require.NoError(t, err)
+	assert.False(t, drift)
+
+	err = c.Required(func() error {
+		drift, err := c.DetectDrift()
+		assert.False(t, drift)
+		return err
+	})
+	require.NoError(t, err)
+
+	b.mu.Lock()
+	require.NoError(t, b.set.SetFlag(cap.Effective, true, cap.BPF)) // behind our back
+	b.mu.Unlock()
+
+	drift, err = c.DetectDrift()
+	require.NoError(t, err)
+	assert.True(t, drift)
+	assert.Contains(t, logs.String(), "cap_bpf")
+
+	require.NoError(t, c.Required(func() error { return nil }))
+	drift, err = c.DetectDrift()
+	require.NoError(t, err)
+	assert.False(t, drift) // back in sync
+}
+
+func TestEnterRequested(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	restore, err := c.EnterRequested(cap.NET_ADMIN)
+	require.NoError(t, err)
+	assert.Equal(t, Requested, c.EffectiveRing())
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, b.effective())
+	require.NoError(t, restore())
+	require.NoError(t, restore()) // no-op
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+	assert.Empty(t, b.effective())
+
+	err = c.Required(func() error {
+		restore, err := c.EnterRequested(cap.NET_ADMIN)
+		if err != nil {
+			return err
+		}
+		assert.Contains(t, b.effective(), cap.NET_ADMIN)
+		return restore()
+	})
+	require.NoError(t, err)
+	assert.Empty(t, b.effective())
+
+	_, err = c.EnterRequested(cap.NET_RAW) // not permitted
+	assert.Error(t, err)
+	assert.Zero(t, atomic.LoadInt32(&c.owner)) // left
+
+	require.NoError(t, c.Confine(Requested, cap.SYS_ADMIN))
+	_, err = c.EnterRequested(cap.NET_ADMIN)
+	assert.ErrorContains(t, err, "confined")
+	assert.Empty(t, b.effective())
+}
+
+func TestHasEffective(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	on, err := c.HasEffective(cap.PERFMON)
+	require.NoError(t, err)
+	assert.False(t, on)
+
+	err = c.Required(func() error {
+		on, err := c.HasEffective(cap.PERFMON)
+		assert.True(t, on)
+		return err
+	})
+	require.NoError(t, err)
+
+	_, err = c.HasEffective(cap.Value(9999))
+	assert.Error(t, err)
+
+	bypassed := &Capabilities{backend: newFakeBackend(t, cap.PERFMON)}
+	require.NoError(t, bypassed.initialize(true))
+	on, err = bypassed.HasEffective(cap.PERFMON)
+	require.NoError(t, err)
+	assert.True(t, on) // real state
+}
+
+func TestErrAlreadyInitialized(t *testing.T) {
+	oldCaps := caps
+	defer func() { caps = oldCaps }()
+	caps = nil
+
+	err := Initialize(true, ParanoidThreshold(MaxParanoiaLevel+1))
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrAlreadyInitialized)
+	assert.Nil(t, caps) // a failed initialization can be retried
+
+	require.NoError(t, Initialize(true))
+	assert.ErrorIs(t, Initialize(true), ErrAlreadyInitialized)
+
+	c, errs := InitializeBestEffort(true)
+	assert.Same(t, caps, c)
+	require.Len(t, errs, 1)
+	assert.ErrorIs(t, errs[0], ErrAlreadyInitialized)
+
+	require.NoError(t, caps.Restore())
+	assert.NoError(t, Initialize(true))
+}
+
+func TestGetInstanceConcurrently(t *testing.T) {
+	oldCaps := caps
+	defer func() { caps = oldCaps }()
+	caps = nil
+
+	instances := make([]*Capabilities, 8)
+	var wg sync.WaitGroup
+	for i := range instances {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instances[i] = GetInstance() // run with -race
+		}(i)
+	}
+	wg.Wait()
+
+	require.NotNil(t, instances[0])
+	for _, c := range instances {
+		assert.Same(t, instances[0], c)
+	}
+	assert.Same(t, caps, instances[0])
+}
+
+func TestSetProcError(t *testing.T) {
+	err := couldNotSetProc(unix.EPERM)
+	assert.Equal(t, "could not set capabilities: operation not permitted", err.Error()) // stable
+	assert.ErrorIs(t, err, unix.EPERM)
+
+	var setProcErr *SetProcError
+	require.ErrorAs(t, fmt.Errorf("wrapped: %w", err), &setProcErr)
+	assert.Equal(t, unix.EPERM, setProcErr.Err)
+
+	c := &Capabilities{backend: restrictedBackend{newFakeBackend(t)}}
+	assert.ErrorAs(t, c.initialize(false), &setProcErr)
+}
+
+func TestRequestedNotPermitted(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	setProcs := c.Stats().SetProcs
+
+	called := false
+	err := c.Requested(func() error {
+		called = true
+		return nil
+	}, cap.NET_ADMIN, cap.NET_RAW, cap.SYS_PTRACE)
+	assert.EqualError(t, err, "could not request capabilities: cap_net_raw, cap_sys_ptrace not permitted to this process")
+	assert.False(t, called)
+	assert.Equal(t, setProcs, c.Stats().SetProcs) // no transition attempted
+	assert.Empty(t, c.ring(Requested))
+
+	_, err = c.EnterRequested(cap.NET_RAW)
+	assert.ErrorContains(t, err, "cap_net_raw not permitted")
+}
+
+func TestMinimalCapsFor(t *testing.T) {
+	before, err := cap.GetPID(0)
+	require.NoError(t, err)
+
+	logs := captureLogs(t)
+	values, err := MinimalCapsFor(NoDefaultBase(true), BaseRequired(cap.NET_ADMIN), Features())
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, values)
+	assert.NotContains(t, logs.String(), "dry run") // its output is meant to be piped
+
+	values, err = MinimalCapsFor()
+	require.NoError(t, err)
+	assert.Contains(t, values, cap.IPC_LOCK)
+	assert.Contains(t, values, cap.SYS_RESOURCE)
+	assert.Contains(t, values, cap.BPF) // running kernel supports it
+
+	_, err = MinimalCapsFor(ParanoidThreshold(42))
+	assert.Error(t, err)
+
+	after, err := cap.GetPID(0)
+	require.NoError(t, err)
+	assert.Equal(t, before.String(), after.String()) // nothing applied
+}
+
+func TestRequestedBatch(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN, cap.NET_RAW, cap.SYSLOG)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	setProcs := c.Stats().SetProcs
+
+	var ran []string
+	err := c.RequestedBatch([]RequestedOp{
+		{Callback: func() error {
+			ran = append(ran, "net")
+			assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW, cap.SYSLOG}, b.effective())
+			return nil
+		}, Values: []cap.Value{cap.NET_ADMIN, cap.NET_RAW}},
+		{Callback: func() error {
+			ran = append(ran, "syslog")
+			return nil
+		}, Values: []cap.Value{cap.SYSLOG, cap.NET_ADMIN}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"net", "syslog"}, ran)
+	assert.Equal(t, setProcs+2, c.Stats().SetProcs) // raised and dropped once
+	assert.Empty(t, b.effective())
+
+	failure := errors.New("failure")
+	ran = nil
+	err = c.RequestedBatch([]RequestedOp{
+		{Callback: func() error { return failure }, Values: []cap.Value{cap.NET_ADMIN}},
+		{Callback: func() error { ran = append(ran, "never"); return nil }},
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Empty(t, ran)
+	assert.Empty(t, b.effective())
+}
+
+func TestTransitionLogs(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false, Features(FeatureBPF)))
+	logs := captureLogs(t)
+
+	require.NoError(t, c.Required(func() error { return nil }))
+
+	out := logs.String()
+	assert.Regexp(t, `"seq":(\d+),"from":"unprivileged","to":"required"`, out)
+	assert.Regexp(t, `"seq":(\d+),"from":"required","to":"unprivileged"`, out)
+
+	seqs := regexp.MustCompile(`"seq":(\d+)`).FindAllStringSubmatch(out, -1)
+	require.Len(t, seqs, 2)
+	first, _ := strconv.Atoi(seqs[0][1])
+	second, _ := strconv.Atoi(seqs[1][1])
+	assert.Equal(t, first+1, second)
+	assert.Equal(t, 3, strings.Count(out, `"enabling"`))
+	assert.Equal(t, 3, strings.Count(out, `"disabling"`)) // dropped ones are logged too
+}
+
+func TestDropTemporarily(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	required := c.ListRequired()
+
+	err := c.Requested(func() error {
+		err := c.DropTemporarily(func() error {
+			assert.Empty(t, b.effective())
+			assert.Equal(t, Unprivileged, c.EffectiveRing())
+			return c.Required(func() error {
+				assert.Equal(t, required, b.effective())
+				return nil
+			})
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []cap.Value{cap.NET_ADMIN}, b.effective()) // enclosing ring restored
+		assert.Equal(t, Requested, c.EffectiveRing())
+		return nil
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+	assert.Empty(t, b.effective())
+
+	errCb := errors.New("plugin failed")
+	err = c.Requested(func() error {
+		return c.DropTemporarily(func() error { return errCb })
+	}, cap.NET_ADMIN)
+	assert.ErrorIs(t, err, errCb)
+	assert.Empty(t, b.effective())
+
+	called := false
+	require.NoError(t, (&Capabilities{bypass: true}).DropTemporarily(func() error {
+		called = true
+		return nil
+	}))
+	assert.True(t, called)
+	assert.ErrorIs(t, (&Capabilities{}).DropTemporarily(func() error { return nil }), ErrNotInitialized)
+}
+
+func TestNestedCalls(t *testing.T) {
+	var all []cap.Value
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		all = append(all, v)
+	}
+	b := newFakeBackend(t, all...)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	required := c.ListRequired()
+
+	noop := func() error { return nil }
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{"ForFeature", func() error { return c.ForFeature(FeatureBPF, noop) }},
+		{"RequestedBestEffort", func() error {
+			return c.RequestedBestEffort(func([]cap.Value) error { return nil }, cap.NET_ADMIN)
+		}},
+		{"ListRequired", func() error {
+			assert.Equal(t, required, c.ListRequired())
+			return nil
+		}},
+		{"IsRequired", func() error {
+			assert.True(t, c.IsRequired(required[0]))
+			return nil
+		}},
+		{"CanEnter", func() error {
+			ok, _ := c.CanEnter(Required)
+			assert.True(t, ok)
+			return nil
+		}},
+		{"Stats", func() error {
+			assert.NotEmpty(t, c.Stats().Transitions)
+			return nil
+		}},
+		{"Info", func() error {
+			assert.Equal(t, required, c.Info().Required)
+			return nil
+		}},
+		{"Explain", func() error {
+			assert.NotEmpty(t, c.Explain())
+			return nil
+		}},
+		{"readers", func() error {
+			c.SimulateDrop(cap.BPF)
+			c.AllPotentialCaps()
+			c.RenderDOT()
+			c.RequirementsFor(FeatureBPF)
+			_, err := c.DumpState()
+			return err
+		}},
+		{"mutators", func() error {
+			c.SetMetrics(nil)
+			c.SetRingChangeHook(nil)
+			c.SetPrivilegedWatchdog(0)
+			for _, err := range []error{
+				c.Confine(Requested, cap.SYS_ADMIN),
+				c.Unconfine(Requested),
+				c.Require(cap.NET_RAW),
+				c.Unrequire(cap.NET_RAW),
+				c.RequireForFeature("nested", cap.NET_RAW),
+				c.ForceUnrequire(cap.NET_RAW),
+				c.RegisterRequirement("registered", cap.NET_RAW),
+				c.BeginPhase("nested"),
+				c.RequireForPhase("nested", cap.NET_RAW),
+				c.EndPhase("nested"),
+			} {
+				if err != nil {
+					return err
+				}
+			}
+			_, err := c.UnregisterRequirement("registered")
+			return err
+		}},
+		{"WithFeatureCaps", func() error { // last, it grows the required ring
+			return c.WithFeatureCaps("nested", []cap.Value{cap.NET_ADMIN}, func([]cap.Value) error { return nil })
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				done <- c.Privileged(tc.call)
+			}()
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "deadlocked when called from a ring callback")
+			}
+			assert.Empty(t, b.effective())
+		})
+	}
+}
+
+func TestRequireWithinRequired(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	// as the eBPF probes do when network events are enabled
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Required(func() error {
+			return c.Require(cap.NET_ADMIN)
+		})
+	}()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "deadlocked requiring from a ring callback")
+	}
+	assert.True(t, c.IsRequired(cap.NET_ADMIN))
+	assert.Empty(t, b.effective())
+
+	require.NoError(t, c.Required(func() error {
+		assert.Contains(t, b.effective(), cap.NET_ADMIN)
+		c.Seal()
+		assert.ErrorContains(t, c.Require(cap.NET_RAW), "sealed")
+		assert.ErrorContains(t, c.Restore(), "called from a ring callback")
+		return nil
+	}))
+
+	// rings are still exclusive: other goroutines wait for the ring to be left
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = c.Required(func() error {
+			close(entered)
+			<-release
+			return nil
+		})
+	}()
+	<-entered
+	required := make(chan struct{})
+	go func() {
+		assert.NoError(t, c.Unrequire(cap.NET_ADMIN))
+		close(required)
+	}()
+	select {
+	case <-required:
+		require.FailNow(t, "required ring changed while in a ring")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-required
+	assert.False(t, c.IsRequired(cap.NET_ADMIN))
+}
@@ -0,0 +1,73 @@
+package capabilities
+
+import "kernel.org/pub/linux/libs/security/libcap/cap"
+
+// CapInfo describes a capability available in the running environment.
+type CapInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Permitted   bool   `json:"permitted"` // in the permitted set of the process
+}
+
+// descriptions are short descriptions of the capabilities (see capabilities(7)).
+var descriptions = map[cap.Value]string{
+	cap.CHOWN:              "make arbitrary changes to file UIDs and GIDs",
+	cap.DAC_OVERRIDE:       "bypass file read, write and execute permission checks",
+	cap.DAC_READ_SEARCH:    "bypass file read and directory read and execute permission checks",
+	cap.FOWNER:             "bypass permission checks on operations requiring the file owner",
+	cap.FSETID:             "keep set-user-ID and set-group-ID bits when a file is modified",
+	cap.KILL:               "bypass permission checks for sending signals",
+	cap.SETGID:             "make arbitrary manipulations of process GIDs",
+	cap.SETUID:             "make arbitrary manipulations of process UIDs",
+	cap.SETPCAP:            "change the bounding set, securebits and inheritable capabilities",
+	cap.LINUX_IMMUTABLE:    "set the immutable and append-only file flags",
+	cap.NET_BIND_SERVICE:   "bind a socket to privileged ports (below 1024)",
+	cap.NET_BROADCAST:      "make socket broadcasts and listen to multicasts",
+	cap.NET_ADMIN:          "perform network administration (interfaces, routing, firewall)",
+	cap.NET_RAW:            "use raw and packet sockets",
+	cap.IPC_LOCK:           "lock memory (mlock, mmap, BPF maps memory)",
+	cap.IPC_OWNER:          "bypass permission checks for System V IPC objects",
+	cap.SYS_MODULE:         "load and unload kernel modules",
+	cap.SYS_RAWIO:          "perform I/O port operations and access /dev/mem",
+	cap.SYS_CHROOT:         "use chroot and change mount namespaces",
+	cap.SYS_PTRACE:         "trace and inspect arbitrary processes",
+	cap.SYS_PACCT:          "use process accounting",
+	cap.SYS_ADMIN:          "perform a range of system administration operations",
+	cap.SYS_BOOT:           "reboot and load new kernels",
+	cap.SYS_NICE:           "raise process priorities and change scheduling",
+	cap.SYS_RESOURCE:       "override resource limits (like locked memory)",
+	cap.SYS_TIME:           "set the system and real-time clocks",
+	cap.SYS_TTY_CONFIG:     "use vhangup and privileged terminal operations",
+	cap.MKNOD:              "create special files",
+	cap.LEASE:              "establish leases on arbitrary files",
+	cap.AUDIT_WRITE:        "write records to the kernel audit log",
+	cap.AUDIT_CONTROL:      "configure kernel auditing",
+	cap.SETFCAP:            "set file capabilities",
+	cap.MAC_OVERRIDE:       "override mandatory access control",
+	cap.MAC_ADMIN:          "configure mandatory access control",
+	cap.SYSLOG:             "use privileged syslog operations and see kernel addresses",
+	cap.WAKE_ALARM:         "trigger something that will wake up the system",
+	cap.BLOCK_SUSPEND:      "block system suspend",
+	cap.AUDIT_READ:         "read the kernel audit log through multicast netlink",
+	cap.PERFMON:            "use performance monitoring (perf events)",
+	cap.BPF:                "use privileged eBPF operations (load programs, create maps)",
+	cap.CHECKPOINT_RESTORE: "use checkpoint and restore operations",
+}
+
+// ListAvailCapsDetailed lists available capabilities in the running environment,
+// describing them and telling whether they are permitted (and so, can be used).
+func ListAvailCapsDetailed() []CapInfo {
+	var infos []CapInfo
+
+	current := getThreadCaps()
+	for v := cap.Value(0); v < cap.MaxBits(); v++ {
+		permitted, _ := current.GetFlag(cap.Permitted, v)
+		infos = append(infos, CapInfo{
+			Name:        NameOf(v),
+			Description: descriptions[v],
+			Permitted:   permitted,
+		})
+	}
+
+	return infos
+}
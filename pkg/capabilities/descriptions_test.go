@@ -0,0 +1,27 @@
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestListAvailCapsDetailed(t *testing.T) {
+	old := getThreadCaps
+	defer func() { getThreadCaps = old }()
+	getThreadCaps = func() *cap.Set {
+		set := cap.NewSet()
+		_ = set.SetFlag(cap.Permitted, true, cap.BPF)
+		return set
+	}
+
+	infos := ListAvailCapsDetailed()
+	require.Len(t, infos, int(cap.MaxBits()))
+	for i, info := range infos {
+		assert.Equal(t, cap.Value(i).String(), info.Name)
+		assert.NotEmpty(t, info.Description, info.Name)
+		assert.Equal(t, cap.Value(i) == cap.BPF, info.Permitted, info.Name)
+	}
+}
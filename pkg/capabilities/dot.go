@@ -0,0 +1,92 @@
+package capabilities
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// RenderDOT renders the capabilities model as a Graphviz DOT digraph: rings and
+// features are nodes with edges to the capabilities Effective in each ring, or
+// required by each feature. The Privileged ring has all capabilities, so its
+// edges are omitted. An empty string is returned if not initialized.
+func (c *Capabilities) RenderDOT() string {
+	if !c.initialized() {
+		return ""
+	}
+
+	var b strings.Builder
+
+	b.WriteString("digraph capabilities {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [fontname=\"monospace\"];\n")
+
+	if c.bypass {
+		b.WriteString("\t\"bypass\" [shape=note, label=\"capabilities management bypassed\"];\n")
+		b.WriteString("}\n")
+		return b.String()
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	used := make(map[cap.Value]bool)
+	var edges []string
+
+	for _, t := range []Ring{Privileged, Required, Requested, Unprivileged} {
+		label := t.String()
+		if t == Privileged {
+			label += "\\n(all capabilities)"
+		}
+		fmt.Fprintf(&b, "\t%s [shape=box, style=filled, fillcolor=lightgrey, label=%s];\n", dotID("ring:"+t.String()), dotID(label))
+		if t == Privileged {
+			continue
+		}
+		for _, v := range c.ring(t) {
+			used[v] = true
+			edges = append(edges, fmt.Sprintf("\t%s -> %s;\n", dotID("ring:"+t.String()), dotID(NameOf(v))))
+		}
+	}
+
+	features := make([]string, 0, len(c.features))
+	for feature := range c.features {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	for _, feature := range features {
+		fmt.Fprintf(&b, "\t%s [shape=ellipse, label=%s];\n", dotID("feature:"+feature), dotID("feature: "+feature))
+		values := append([]cap.Value{}, c.features[feature]...)
+		sortValues(values)
+		for i, v := range values {
+			if i > 0 && values[i-1] == v {
+				continue
+			}
+			used[v] = true
+			edges = append(edges, fmt.Sprintf("\t%s -> %s [style=dashed];\n", dotID("feature:"+feature), dotID(NameOf(v))))
+		}
+	}
+
+	values := make([]cap.Value, 0, len(used))
+	for v := range used {
+		values = append(values, v)
+	}
+	sortValues(values)
+	for _, v := range values {
+		fmt.Fprintf(&b, "\t%s [shape=plaintext];\n", dotID(NameOf(v)))
+	}
+
+	for _, edge := range edges {
+		b.WriteString(edge)
+	}
+	b.WriteString("}\n")
+
+	return b.String()
+}
+
+// dotID quotes the given string as a DOT identifier.
+func dotID(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,47 @@
+package capabilities
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestRenderDOT(t *testing.T) {
+	c := newFakeCapabilities(t)
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+	require.NoError(t, c.RequireForFeature(FeatureBPF, cap.BPF))
+	require.NoError(t, c.RequireForFeature(FeaturePerf, cap.PERFMON))
+
+	dot := c.RenderDOT()
+	assertDOT(t, dot)
+
+	assert.Contains(t, dot, `"ring:privileged" [`)
+	assert.Contains(t, dot, `"ring:required" -> "cap_ipc_lock";`)
+	assert.Contains(t, dot, `"ring:required" -> "cap_bpf";`)
+	assert.Contains(t, dot, `"feature:bpf" -> "cap_bpf" [style=dashed];`)
+	assert.Contains(t, dot, `"feature:perf" -> "cap_perfmon" [style=dashed];`)
+	assert.NotContains(t, dot, `"ring:privileged" ->`)
+
+	assertDOT(t, (&Capabilities{bypass: true}).RenderDOT())
+}
+
+// assertDOT checks the given output is a DOT digraph made of node, edge and
+// attribute statements.
+func assertDOT(t *testing.T, dot string) {
+	t.Helper()
+
+	id := `"([^"\\]|\\.)*"`
+	attrs := `( \[[a-z]+=("([^"\\]|\\.)*"|[a-z]+)(, [a-z]+=("([^"\\]|\\.)*"|[a-z]+))*\])?`
+	statement := regexp.MustCompile(`^\t(` + id + `( -> ` + id + `)?` + attrs + `|[a-z]+=[A-Z]+|node` + attrs + `);$`)
+
+	lines := strings.Split(strings.TrimSuffix(dot, "\n"), "\n")
+	require.Equal(t, "digraph capabilities {", lines[0])
+	require.Equal(t, "}", lines[len(lines)-1])
+	for _, line := range lines[1 : len(lines)-1] {
+		assert.Regexp(t, statement, line)
+	}
+}
@@ -0,0 +1,105 @@
+package capabilities
+
+import (
+	"sync"
+	"time"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// subscriberBuffer is the number of events a subscriber may fall behind before
+// events are dropped.
+const subscriberBuffer = 64
+
+// RingEvent is a ring transition, as seen by subscribers (see Subscribe).
+type RingEvent struct {
+	From    Ring        `json:"from"`
+	To      Ring        `json:"to"`
+	Raised  []cap.Value `json:"raised"`  // capabilities made Effective
+	Lowered []cap.Value `json:"lowered"` // capabilities no longer Effective
+	Time    time.Time   `json:"time"`
+}
+
+// subscribers are the channels receiving ring transitions.
+type subscribers struct {
+	lock    sync.Mutex
+	next    int
+	chans   map[int]chan RingEvent
+	dropped uint64 // events not delivered to slow subscribers
+}
+
+// Subscribe returns a channel receiving an event on every ring transition, and
+// a function to unsubscribe (closing the channel). The channel is buffered:
+// events are dropped, instead of blocking ring transitions, if the subscriber
+// does not keep up (see Stats). If not initialized, the channel is already
+// closed.
+func (c *Capabilities) Subscribe() (<-chan RingEvent, func()) {
+	if !c.initialized() {
+		ch := make(chan RingEvent)
+		close(ch)
+		return ch, func() {}
+	}
+
+	ch := make(chan RingEvent, subscriberBuffer)
+
+	c.subs.lock.Lock()
+	if c.subs.chans == nil {
+		c.subs.chans = make(map[int]chan RingEvent)
+	}
+	id := c.subs.next
+	c.subs.next++
+	c.subs.chans[id] = ch
+	c.subs.lock.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			c.subs.lock.Lock()
+			delete(c.subs.chans, id)
+			c.subs.lock.Unlock()
+			close(ch)
+		})
+	}
+
+	return ch, unsubscribe
+}
+
+// SetRingChangeHook registers a function called, synchronously, on every ring
+// change with the previous and the new ring, replacing any previous one (nil
+// unregisters it). Unlike subscribers, it can capture the stack of the goroutine
+// changing rings. It is called twice while holding the capabilities lock:
+// before the process capabilities are changed and after (whether changing them
+// failed or not). It must not call back into the capabilities package. It does
+// nothing if not initialized.
+func (c *Capabilities) SetRingChangeHook(hook func(from, to Ring)) {
+	if !c.initialized() || c.bypass {
+		return
+	}
+
+	unlock := c.wlock()
+	defer unlock()
+
+	c.ringHook = hook
+}
+
+// publish sends the given event to all subscribers, never blocking.
+func (c *Capabilities) publish(event RingEvent) {
+	c.subs.lock.Lock()
+	defer c.subs.lock.Unlock()
+
+	for _, ch := range c.subs.chans {
+		select {
+		case ch <- event:
+		default:
+			c.subs.dropped++
+		}
+	}
+}
+
+// droppedEvents returns the number of events not delivered to subscribers.
+func (c *Capabilities) droppedEvents() uint64 {
+	c.subs.lock.Lock()
+	defer c.subs.lock.Unlock()
+
+	return c.subs.dropped
+}
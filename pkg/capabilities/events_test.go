@@ -0,0 +1,143 @@
+package capabilities
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestSubscribe(t *testing.T) {
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+	events, unsubscribe := c.Subscribe()
+	other, unsubscribeOther := c.Subscribe()
+	defer unsubscribeOther()
+
+	require.NoError(t, c.Requested(func() error { return nil }, cap.NET_ADMIN))
+
+	for _, ch := range []<-chan RingEvent{events, other} {
+		enter := <-ch
+		assert.Equal(t, Unprivileged, enter.From)
+		assert.Equal(t, Requested, enter.To)
+		assert.Equal(t, []cap.Value{cap.NET_ADMIN}, enter.Raised)
+		assert.False(t, enter.Time.IsZero())
+
+		leave := <-ch
+		assert.Equal(t, Requested, leave.From)
+		assert.Equal(t, Unprivileged, leave.To)
+		assert.Equal(t, []cap.Value{cap.NET_ADMIN}, leave.Lowered)
+	}
+
+	unsubscribe()
+	unsubscribe() // no-op
+	_, open := <-events
+	assert.False(t, open)
+
+	// a slow subscriber does not block transitions
+	for i := 0; i < subscriberBuffer; i++ {
+		require.NoError(t, c.Requested(func() error { return nil }, cap.NET_ADMIN))
+	}
+	assert.Len(t, other, subscriberBuffer)
+	assert.Equal(t, uint64(subscriberBuffer), c.Stats().Dropped)
+}
+
+func TestSetRingChangeHook(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	type change struct {
+		from, to Ring
+	}
+	var changes []change
+	c.SetRingChangeHook(func(from, to Ring) {
+		changes = append(changes, change{from, to})
+		if to == Requested && len(changes)%2 == 1 { // before the change
+			assert.NotContains(t, b.effective(), cap.NET_ADMIN)
+		}
+		if to == Requested && len(changes)%2 == 0 { // after the change
+			assert.Equal(t, []cap.Value{cap.NET_ADMIN}, b.effective())
+		}
+	})
+
+	require.NoError(t, c.Required(func() error {
+		return c.Requested(func() error { return nil }, cap.NET_ADMIN)
+	}))
+	assert.Equal(t, []change{
+		{Unprivileged, Required},
+		{Unprivileged, Required},
+		{Required, Requested},
+		{Required, Requested},
+		{Requested, Required},
+		{Requested, Required},
+		{Required, Unprivileged},
+		{Required, Unprivileged},
+	}, changes)
+
+	// failed changes are reported too
+
+	changes = nil
+	c.backend = restrictedBackend{b}
+	assert.Error(t, c.Required(func() error { return nil }))
+	require.Len(t, changes, 2)
+	assert.Equal(t, change{Unprivileged, Required}, changes[1])
+	c.backend = b
+
+	c.SetRingChangeHook(nil)
+	changes = nil
+	require.NoError(t, c.Required(func() error { return nil }))
+	assert.Empty(t, changes)
+}
+
+// waitForRing blocks until the given ring is applied, as notified to the given
+// subscription (see Subscribe), returning the transition. Transitions to other
+// rings are skipped. It fails the test if the ring is not applied in time.
+func waitForRing(t testing.TB, events <-chan RingEvent, r Ring) RingEvent {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, open := <-events:
+			require.True(t, open, "unsubscribed while waiting for the %v ring", r)
+			if event.To == r {
+				return event
+			}
+		case <-timeout:
+			require.FailNow(t, "timed out waiting for the ring", "ring: %v", r)
+		}
+	}
+}
+
+func TestWaitForRing(t *testing.T) {
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+
+	release := make(chan struct{})
+	errs := make(chan error, 2)
+	go func() {
+		errs <- c.Required(func() error {
+			<-release
+			return nil
+		})
+	}()
+	waitForRing(t, events, Required)
+
+	go func() {
+		errs <- c.Requested(func() error { return nil }, cap.NET_ADMIN)
+	}()
+	close(release) // the requested ring waits for the required one to be left
+
+	assert.Equal(t, Required, waitForRing(t, events, Unprivileged).From)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN}, waitForRing(t, events, Requested).Raised)
+	assert.Equal(t, Requested, waitForRing(t, events, Unprivileged).From)
+	require.NoError(t, <-errs)
+	require.NoError(t, <-errs)
+}
@@ -0,0 +1,100 @@
+package capabilities
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+var statfs = unix.Statfs // variable so tests can simulate filesystems
+
+// CanSetFileCaps probes, without changing anything, whether file capabilities
+// can be set on the given path: the filesystem must be writable and support
+// extended attributes, and CAP_SETFCAP must be permitted. When they can't be
+// set, the returned error tells why.
+func CanSetFileCaps(path string) (bool, error) {
+	var fs unix.Statfs_t
+
+	err := statfs(path, &fs)
+	if err != nil {
+		return false, couldNotSetFileCaps(path, err)
+	}
+	if fs.Flags&unix.ST_RDONLY != 0 {
+		return false, couldNotSetFileCaps(path, errors.New("read-only filesystem"))
+	}
+
+	_, err = unix.Getxattr(path, "security.capability", nil)
+	if errors.Is(err, unix.ENOTSUP) {
+		return false, couldNotSetFileCaps(path, fileCapsError(err))
+	}
+	if err != nil && !errors.Is(err, unix.ENODATA) {
+		return false, couldNotSetFileCaps(path, err)
+	}
+
+	permitted, err := cap.GetProc().GetFlag(cap.Permitted, cap.SETFCAP)
+	if err != nil {
+		return false, couldNotSetFileCaps(path, err)
+	}
+	if !permitted {
+		return false, couldNotSetFileCaps(path, errors.New("cap_setfcap is not permitted"))
+	}
+
+	return true, nil
+}
+
+// GetFileCaps returns the file capabilities of the given file (an empty set if
+// it has none).
+func GetFileCaps(path string) (*cap.Set, error) {
+	set, err := cap.GetFile(path)
+	if errors.Is(err, unix.ENODATA) {
+		return cap.NewSet(), nil
+	}
+	if err != nil {
+		return nil, couldNotGetFileCaps(path, fileCapsError(err))
+	}
+
+	return set, nil
+}
+
+// SetFileCaps sets the file capabilities of the given executable: exec()ing it
+// grants the given permitted capabilities, the given effective ones being
+// effective right away. Setting them needs cap.SETFCAP effective (see
+// Requested). Process capabilities are not changed.
+func SetFileCaps(path string, permitted, effective []cap.Value) error {
+	set := cap.NewSet()
+
+	err := set.SetFlag(cap.Permitted, true, permitted...)
+	if err != nil {
+		return couldNotSetFileCaps(path, err)
+	}
+	err = set.SetFlag(cap.Effective, true, effective...)
+	if err != nil {
+		return couldNotSetFileCaps(path, err)
+	}
+
+	err = set.SetFile(path)
+	if err != nil {
+		return couldNotSetFileCaps(path, fileCapsError(err))
+	}
+
+	return nil
+}
+
+// fileCapsError explains errors of filesystems not supporting file capabilities.
+func fileCapsError(err error) error {
+	if errors.Is(err, unix.ENOTSUP) {
+		return errors.New("filesystem does not support extended attributes")
+	}
+
+	return err
+}
+
+func couldNotGetFileCaps(path string, e error) error {
+	return fmt.Errorf("could not get file capabilities of %v: %w", path, e)
+}
+
+func couldNotSetFileCaps(path string, e error) error {
+	return fmt.Errorf("could not set file capabilities on %v: %w", path, e)
+}
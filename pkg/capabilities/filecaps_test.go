@@ -0,0 +1,91 @@
+package capabilities
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestCanSetFileCaps(t *testing.T) {
+	t.Run("tmpfs", func(t *testing.T) {
+		dir, err := os.MkdirTemp("/dev/shm", "tracee-filecaps")
+		if err != nil {
+			t.Skip("tmpfs is not available")
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "tracee")
+		require.NoError(t, os.WriteFile(path, nil, 0755))
+
+		setfcap, _ := cap.GetProc().GetFlag(cap.Permitted, cap.SETFCAP)
+		ok, err := CanSetFileCaps(path)
+		if setfcap {
+			assert.True(t, ok)
+			assert.NoError(t, err)
+		} else {
+			assert.False(t, ok)
+			assert.EqualError(t, err, "could not set file capabilities on "+path+": cap_setfcap is not permitted")
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		old := statfs
+		defer func() { statfs = old }()
+		statfs = func(path string, buf *unix.Statfs_t) error {
+			buf.Flags = unix.ST_RDONLY
+			return nil
+		}
+
+		ok, err := CanSetFileCaps("/usr/bin/tracee")
+		assert.False(t, ok)
+		assert.EqualError(t, err, "could not set file capabilities on /usr/bin/tracee: read-only filesystem")
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		ok, err := CanSetFileCaps(filepath.Join(t.TempDir(), "missing"))
+		assert.False(t, ok)
+		assert.ErrorContains(t, err, "no such file or directory")
+	})
+}
+
+func TestFileCaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracee")
+	require.NoError(t, os.WriteFile(path, nil, 0755))
+
+	set, err := GetFileCaps(path)
+	require.NoError(t, err)
+	assert.Equal(t, "=", set.String()) // none
+
+	_, err = GetFileCaps(filepath.Join(t.TempDir(), "missing"))
+	assert.ErrorContains(t, err, "could not get file capabilities")
+
+	assert.EqualError(t, fileCapsError(unix.ENOTSUP), "filesystem does not support extended attributes")
+
+	c := newTestCapabilities(t)
+	requirePermitted(t, cap.SETFCAP)
+
+	err = SetFileCaps(path, []cap.Value{cap.NET_ADMIN, cap.BPF}, []cap.Value{cap.BPF})
+	assert.ErrorContains(t, err, "could not set file capabilities") // cap.SETFCAP is not effective
+
+	err = c.Requested(func() error {
+		return SetFileCaps(path, []cap.Value{cap.NET_ADMIN, cap.BPF}, []cap.Value{cap.BPF})
+	}, cap.SETFCAP)
+	if err != nil && strings.Contains(err.Error(), "extended attributes") {
+		t.Skip("filesystem does not support file capabilities")
+	}
+	require.NoError(t, err)
+
+	set, err = GetFileCaps(path)
+	require.NoError(t, err)
+	for _, v := range []cap.Value{cap.NET_ADMIN, cap.BPF} {
+		on, err := set.GetFlag(cap.Permitted, v)
+		require.NoError(t, err)
+		assert.True(t, on, v.String())
+	}
+}
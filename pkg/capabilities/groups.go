@@ -0,0 +1,49 @@
+package capabilities
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// groupPrefix prefixes groups names given to ReqByString.
+const groupPrefix = "group:"
+
+// Groups are named groups of capabilities, so users can configure them without
+// knowing each capability. ReqByString also accepts them, "group:" prefixed.
+var Groups = map[string][]cap.Value{
+	"bpf": {cap.BPF, cap.PERFMON},
+	"net": {cap.NET_ADMIN, cap.NET_RAW},
+}
+
+// ReqByGroup returns the capabilities of the given groups (see Groups).
+func ReqByGroup(names ...string) ([]cap.Value, error) {
+	var values []cap.Value
+
+	for _, name := range names {
+		group, ok := Groups[name]
+		if !ok {
+			return nil, couldNotFindGroup(name)
+		}
+		values = append(values, group...)
+	}
+
+	return values, nil
+}
+
+// ListGroups lists, sorted, the names of the capabilities groups.
+func ListGroups() []string {
+	names := make([]string, 0, len(Groups))
+	for name := range Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func couldNotFindGroup(name string) error {
+	return fmt.Errorf("could not find capabilities group: %v (valid groups: %v)", name, strings.Join(ListGroups(), ", "))
+}
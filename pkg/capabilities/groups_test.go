@@ -0,0 +1,31 @@
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestReqByGroup(t *testing.T) {
+	values, err := ReqByGroup("bpf", "net")
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.BPF, cap.PERFMON, cap.NET_ADMIN, cap.NET_RAW}, values)
+
+	_, err = ReqByGroup("bpf", "storage")
+	assert.EqualError(t, err, "could not find capabilities group: storage (valid groups: bpf, net)")
+
+	values, err = ReqByString("cap_kill", "group:net", "GROUP:bpf")
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.KILL, cap.NET_ADMIN, cap.NET_RAW, cap.BPF, cap.PERFMON}, values)
+
+	values, err = ReqByString("bpf") // a capability, not the group
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.BPF}, values)
+
+	_, err = ReqByString("net")
+	assert.EqualError(t, err, "could not find capability: net")
+	_, err = ReqByString("group:storage")
+	assert.EqualError(t, err, "could not find capability: group:storage")
+}
@@ -0,0 +1,136 @@
+package capabilities
+
+import (
+	"fmt"
+
+	"github.com/aquasecurity/tracee/pkg/logger"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// phaseFeature is the feature registering the capabilities needed by a phase.
+func phaseFeature(phase string) string {
+	return "phase:" + phase
+}
+
+// RequireForPhase requires the given capabilities for a startup phase (config
+// load, eBPF load, ...), registering them as the "phase:<name>" feature. Once
+// the phase ends (see EndPhase) the capabilities it added to the required ring
+// are dropped, unless another feature (or a later phase) still needs them.
+func (c *Capabilities) RequireForPhase(phase string, values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	added := c.notIn(Required, values...)
+	err := c.require(phaseFeature(phase), values...)
+	if err != nil {
+		return err
+	}
+
+	if c.phases == nil {
+		c.phases = make(map[string][]cap.Value)
+	}
+	c.phases[phase] = append(c.phases[phase], added...)
+
+	return nil
+}
+
+// BeginPhase marks the beginning of the given startup phase. Phases are
+// sequential: the previous phase must have ended.
+func (c *Capabilities) BeginPhase(phase string) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock()
+	defer unlock()
+
+	if c.phase != "" {
+		return couldNotBeginPhase(phase, fmt.Errorf("phase %v did not end", c.phase))
+	}
+	c.phase = phase
+	logger.Debug("phase began", "pkg", pkgName, "phase", phase)
+
+	return nil
+}
+
+// EndPhase marks the end of the given startup phase, dropping from the required
+// ring the capabilities no other feature (or later phase) needs.
+func (c *Capabilities) EndPhase(phase string) error {
+	if !c.initialized() {
+		return couldNotUseUninitialized()
+	}
+
+	var dropped []cap.Value
+
+	if c.bypass {
+		return nil
+	}
+
+	unlock := c.wlock()
+	defer unlock()
+
+	if c.phase != phase {
+		return couldNotEndPhase(phase, fmt.Errorf("current phase is %q", c.phase))
+	}
+
+	delete(c.features, phaseFeature(phase))
+	owned := c.phases[phase]
+	delete(c.phases, phase)
+
+	for _, v := range owned {
+		if later := c.laterPhase(v); later != "" {
+			c.phases[later] = append(c.phases[later], v) // dropped when it ends
+			continue
+		}
+		if c.neededByFeature(v) || c.direct[v] > 0 || !c.all[v][Required] {
+			continue
+		}
+		dropped = append(dropped, v)
+	}
+	c.phase = ""
+
+	err := c.unset(Required, dropped...)
+	if err != nil {
+		return err
+	}
+	sortValues(dropped)
+	c.writeAudit("unrequire", Required, phaseFeature(phase), nil, dropped)
+	logger.Debug("phase ended", "pkg", pkgName, "phase", phase, "dropped", capNames(dropped))
+
+	return nil
+}
+
+// laterPhase returns a phase, not ended yet, needing the given capability.
+func (c *Capabilities) laterPhase(v cap.Value) string {
+	for phase := range c.phases {
+		if c.neededBy(phaseFeature(phase), v) {
+			return phase
+		}
+	}
+
+	return ""
+}
+
+// neededByFeature tells whether any registered feature needs the given
+// capability.
+func (c *Capabilities) neededByFeature(v cap.Value) bool {
+	for feature := range c.features {
+		if c.neededBy(feature, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func couldNotBeginPhase(phase string, e error) error {
+	return fmt.Errorf("could not begin phase %v: %w", phase, e)
+}
+
+func couldNotEndPhase(phase string, e error) error {
+	return fmt.Errorf("could not end phase %v: %w", phase, e)
+}
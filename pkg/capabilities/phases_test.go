@@ -0,0 +1,33 @@
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestPhases(t *testing.T) {
+	c := newFakeCapabilities(t)
+	require.NoError(t, c.RequireForFeature(FeatureBPF, cap.BPF))
+	require.NoError(t, c.RequireForPhase("config", cap.DAC_READ_SEARCH, cap.SYS_PTRACE))
+	require.NoError(t, c.RequireForPhase("ebpf", cap.SYS_PTRACE, cap.BPF, cap.SYS_RESOURCE))
+
+	all := []cap.Value{cap.DAC_READ_SEARCH, cap.SYS_PTRACE, cap.SYS_RESOURCE, cap.BPF}
+	assert.Equal(t, all, c.Info().Required)
+
+	require.NoError(t, c.BeginPhase("config"))
+	assert.Equal(t, "config", c.Info().Phase)
+	assert.EqualError(t, c.BeginPhase("ebpf"), "could not begin phase ebpf: phase config did not end")
+	assert.EqualError(t, c.EndPhase("ebpf"), `could not end phase ebpf: current phase is "config"`)
+
+	require.NoError(t, c.EndPhase("config"))
+	assert.Equal(t, []cap.Value{cap.SYS_PTRACE, cap.SYS_RESOURCE, cap.BPF}, c.Info().Required) // ebpf needs cap.SYS_PTRACE
+	assert.Empty(t, c.Info().Phase)
+
+	require.NoError(t, c.BeginPhase("ebpf"))
+	require.NoError(t, c.EndPhase("ebpf"))
+	assert.Equal(t, []cap.Value{cap.BPF}, c.Info().Required) // bpf feature needs cap.BPF
+	assert.NotContains(t, c.Info().Features, "phase:ebpf")
+}
@@ -0,0 +1,96 @@
+package capabilities
+
+import (
+	"github.com/aquasecurity/tracee/pkg/logger"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// FeaturePrograms is the feature whose capabilities are derived from the eBPF
+// program types actually loaded (see RequireForProgramTypes).
+const FeaturePrograms = "programs"
+
+// programTypeCaps are the capabilities needed to load, and attach, each eBPF
+// program (or attach) type. Tracing programs need cap.PERFMON, networking ones
+// need cap.NET_ADMIN (except socket filters), all of them need cap.BPF.
+var programTypeCaps = map[string][]cap.Value{
+	// tracing
+	"kprobe":         {cap.BPF, cap.PERFMON},
+	"kretprobe":      {cap.BPF, cap.PERFMON},
+	"uprobe":         {cap.BPF, cap.PERFMON},
+	"uretprobe":      {cap.BPF, cap.PERFMON},
+	"tracepoint":     {cap.BPF, cap.PERFMON},
+	"raw_tracepoint": {cap.BPF, cap.PERFMON},
+	"perf_event":     {cap.BPF, cap.PERFMON},
+	"fentry":         {cap.BPF, cap.PERFMON},
+	"fexit":          {cap.BPF, cap.PERFMON},
+	"lsm":            {cap.BPF, cap.PERFMON},
+	// networking
+	"tc":            {cap.BPF, cap.NET_ADMIN},
+	"sched_cls":     {cap.BPF, cap.NET_ADMIN},
+	"sched_act":     {cap.BPF, cap.NET_ADMIN},
+	"xdp":           {cap.BPF, cap.NET_ADMIN},
+	"cgroup_skb":    {cap.BPF, cap.NET_ADMIN},
+	"cgroup_sock":   {cap.BPF, cap.NET_ADMIN},
+	"socket_filter": {cap.BPF}, // attached to sockets the process owns
+}
+
+// CapsForProgramTypes returns the capabilities needed to load the given eBPF
+// program (or attach) types, so the required capabilities can be derived from
+// the programs actually loaded. Unknown types are assumed to need cap.SYS_ADMIN.
+func CapsForProgramTypes(types []string) []cap.Value {
+	var values []cap.Value
+
+	needed := make(map[cap.Value]bool)
+	for _, t := range types {
+		caps, ok := programTypeCaps[t]
+		if !ok {
+			logger.Debug("unknown eBPF program type, assuming CAP_SYS_ADMIN", "pkg", pkgName, "type", t)
+			caps = []cap.Value{cap.SYS_ADMIN}
+		}
+		for _, v := range caps {
+			needed[v] = true
+		}
+	}
+	for v := range needed {
+		values = append(values, v)
+	}
+	sortValues(values)
+
+	return values
+}
+
+// RequireForProgramTypes requires, for FeaturePrograms, the capabilities needed
+// by the given eBPF program types. Without cap.BPF support, cap.BPF and
+// cap.PERFMON fall back to cap.SYS_ADMIN (like the builtin features do).
+func (c *Capabilities) RequireForProgramTypes(types ...string) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	values := CapsForProgramTypes(types)
+	if !c.hasBPF { // only written during init
+		values = withoutBPF(values)
+	}
+
+	return c.RequireForFeature(FeaturePrograms, values...)
+}
+
+// withoutBPF replaces cap.BPF and cap.PERFMON by cap.SYS_ADMIN.
+func withoutBPF(values []cap.Value) []cap.Value {
+	var replaced []cap.Value
+
+	sysAdmin := false
+	for _, v := range values {
+		if v == cap.BPF || v == cap.PERFMON || v == cap.SYS_ADMIN {
+			if !sysAdmin {
+				replaced = append(replaced, cap.SYS_ADMIN)
+				sysAdmin = true
+			}
+			continue
+		}
+		replaced = append(replaced, v)
+	}
+	sortValues(replaced)
+
+	return replaced
+}
@@ -0,0 +1,41 @@
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestCapsForProgramTypes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		types    []string
+		expected []cap.Value
+	}{
+		{name: "none", types: nil, expected: nil},
+		{name: "tracing", types: []string{"kprobe", "tracepoint", "uprobe"}, expected: []cap.Value{cap.PERFMON, cap.BPF}},
+		{name: "networking", types: []string{"tc", "xdp"}, expected: []cap.Value{cap.NET_ADMIN, cap.BPF}},
+		{name: "socket filter", types: []string{"socket_filter"}, expected: []cap.Value{cap.BPF}},
+		{name: "mixed", types: []string{"kprobe", "cgroup_skb"}, expected: []cap.Value{cap.NET_ADMIN, cap.PERFMON, cap.BPF}},
+		{name: "unknown", types: []string{"kprobe", "struct_ops"}, expected: []cap.Value{cap.SYS_ADMIN, cap.PERFMON, cap.BPF}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, CapsForProgramTypes(tc.types))
+		})
+	}
+}
+
+func TestRequireForProgramTypes(t *testing.T) {
+	c := newFakeCapabilities(t)
+	c.hasBPF = true
+	require.NoError(t, c.RequireForProgramTypes("kprobe", "tc"))
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.PERFMON, cap.BPF}, c.Info().Features[FeaturePrograms])
+
+	c = newFakeCapabilities(t) // no cap.BPF support
+	require.NoError(t, c.RequireForProgramTypes("kprobe", "tc"))
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.SYS_ADMIN}, c.Info().Features[FeaturePrograms])
+}
@@ -0,0 +1,83 @@
+package capabilities
+
+import (
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// RegisterRequirement registers the given capabilities as needed by the given
+// feature, requiring them (like RequireForFeature does). Registering them again
+// does nothing. Once the feature is disabled, UnregisterRequirement drops them.
+func (c *Capabilities) RegisterRequirement(feature string, values ...cap.Value) error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	var unregistered []cap.Value
+	for _, v := range values {
+		if !c.neededBy(feature, v) {
+			unregistered = append(unregistered, v)
+		}
+	}
+
+	return c.require(feature, unregistered...)
+}
+
+// RequirementsFor returns, sorted, the capabilities registered as needed by the
+// given feature (see RegisterRequirement and RequireForFeature).
+func (c *Capabilities) RequirementsFor(feature string) []cap.Value {
+	if !c.initialized() || c.bypass {
+		return nil
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	values := dedupValues(c.features[feature])
+	sortValues(values)
+
+	return values
+}
+
+// UnregisterRequirement unregisters the capabilities needed by the given
+// (disabled) feature, dropping from the required ring the ones no other feature
+// needs and that were not required directly (see Require). It returns the
+// dropped capabilities.
+func (c *Capabilities) UnregisterRequirement(feature string) ([]cap.Value, error) {
+	if !c.initialized() {
+		return nil, couldNotUseUninitialized()
+	}
+
+	var dropped []cap.Value
+
+	if c.bypass {
+		return nil, nil
+	}
+
+	unlock := c.wlock() // do not change caps while in a protective ring
+	defer unlock()
+
+	values, ok := c.features[feature]
+	if !ok {
+		return nil, couldNotFindFeature(feature)
+	}
+	delete(c.features, feature)
+
+	for _, v := range dedupValues(values) {
+		if c.neededByFeature(v) || c.direct[v] > 0 || !c.all[v][Required] {
+			continue
+		}
+		dropped = append(dropped, v)
+	}
+
+	err := c.unset(Required, dropped...)
+	if err != nil {
+		return nil, err
+	}
+	sortValues(dropped)
+	c.writeAudit("unrequire", Required, feature, nil, dropped)
+
+	return dropped, nil
+}
@@ -0,0 +1,59 @@
+package capabilities
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestRegisterRequirement(t *testing.T) {
+	c := newFakeCapabilities(t)
+
+	require.NoError(t, c.Require(cap.IPC_LOCK))
+	require.NoError(t, c.RegisterRequirement("capture", cap.NET_ADMIN, cap.IPC_LOCK))
+	require.NoError(t, c.RegisterRequirement("capture", cap.NET_ADMIN)) // registered once
+	require.NoError(t, c.RegisterRequirement("dns", cap.NET_ADMIN, cap.NET_RAW))
+
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.IPC_LOCK}, c.RequirementsFor("capture"))
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW}, c.RequirementsFor("dns"))
+	assert.Empty(t, c.RequirementsFor("unknown"))
+
+	dropped, err := c.UnregisterRequirement("capture")
+	require.NoError(t, err)
+	assert.Empty(t, dropped) // cap.NET_ADMIN needed by dns, cap.IPC_LOCK required directly
+	assert.Empty(t, c.RequirementsFor("capture"))
+	assert.ElementsMatch(t, []cap.Value{cap.IPC_LOCK, cap.NET_ADMIN, cap.NET_RAW}, c.ring(Required))
+
+	dropped, err = c.UnregisterRequirement("dns")
+	require.NoError(t, err)
+	assert.Equal(t, []cap.Value{cap.NET_ADMIN, cap.NET_RAW}, dropped)
+	assert.Equal(t, []cap.Value{cap.IPC_LOCK}, c.ring(Required))
+
+	_, err = c.UnregisterRequirement("dns")
+	assert.Error(t, err)
+}
+
+func TestRequireReferenceCounted(t *testing.T) {
+	c := newFakeCapabilities(t)
+
+	require.NoError(t, c.Require(cap.NET_ADMIN))                // first subsystem
+	require.NoError(t, c.Require(cap.NET_ADMIN, cap.NET_ADMIN)) // second one (counted once)
+	require.NoError(t, c.Unrequire(cap.NET_ADMIN))
+	assert.True(t, c.IsRequired(cap.NET_ADMIN)) // still required by the other
+	require.NoError(t, c.Unrequire(cap.NET_ADMIN))
+	assert.False(t, c.IsRequired(cap.NET_ADMIN))
+	require.NoError(t, c.Unrequire(cap.NET_ADMIN)) // nothing left to release
+	assert.False(t, c.IsRequired(cap.NET_ADMIN))
+
+	require.NoError(t, c.RegisterRequirement("dns", cap.NET_RAW))
+	require.NoError(t, c.Require(cap.NET_RAW))
+	require.NoError(t, c.Unrequire(cap.NET_RAW))
+	assert.True(t, c.IsRequired(cap.NET_RAW)) // still needed by dns
+
+	require.NoError(t, c.Require(cap.SYSLOG))
+	require.NoError(t, c.Require(cap.SYSLOG))
+	require.NoError(t, c.ForceUnrequire(cap.SYSLOG, cap.NET_RAW))
+	assert.Empty(t, c.ListRequired())
+}
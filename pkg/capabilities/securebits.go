@@ -0,0 +1,251 @@
+package capabilities
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aquasecurity/tracee/pkg/logger"
+	"golang.org/x/sys/unix"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+var getSecurebits = readSecurebits  // variable so tests can simulate securebits
+var setNoNewPrivs = writeNoNewPrivs // variable so tests don't set no_new_privs
+var setSecurebits = SetSecurebits   // variable so tests don't lock securebits
+
+// Securebits are the securebits of the process, and its no_new_privs flag,
+// which constrain how capabilities can be gained.
+type Securebits struct {
+	NoRoot                  bool `json:"noRoot"`
+	NoRootLocked            bool `json:"noRootLocked"`
+	NoSetuidFixup           bool `json:"noSetuidFixup"`
+	NoSetuidFixupLocked     bool `json:"noSetuidFixupLocked"`
+	KeepCaps                bool `json:"keepCaps"`
+	KeepCapsLocked          bool `json:"keepCapsLocked"`
+	NoCapAmbientRaise       bool `json:"noCapAmbientRaise"`
+	NoCapAmbientRaiseLocked bool `json:"noCapAmbientRaiseLocked"`
+	NoNewPrivs              bool `json:"noNewPrivs"`
+}
+
+// SecurebitsState returns the current securebits of the process.
+func SecurebitsState() (Securebits, error) {
+	return getSecurebits()
+}
+
+// Securebits flags (see GetSecurebits and SetSecurebits), as defined by libcap.
+const (
+	SecbitNoRoot                  = uint(cap.SecbitNoRoot)
+	SecbitNoRootLocked            = uint(cap.SecbitNoRootLocked)
+	SecbitNoSetUIDFixup           = uint(cap.SecbitNoSetUIDFixup)
+	SecbitNoSetUIDFixupLocked     = uint(cap.SecbitNoSetUIDFixupLocked)
+	SecbitKeepCaps                = uint(cap.SecbitKeepCaps)
+	SecbitKeepCapsLocked          = uint(cap.SecbitKeepCapsLocked)
+	SecbitNoCapAmbientRaise       = uint(cap.SecbitNoCapAmbientRaise)
+	SecbitNoCapAmbientRaiseLocked = uint(cap.SecbitNoCapAmbientRaiseLocked)
+)
+
+// GetSecurebits returns the securebits of the process (Secbit flags).
+func GetSecurebits() (uint, error) {
+	bits, err := cap.Prctl(unix.PR_GET_SECUREBITS)
+	if err != nil {
+		return 0, couldNotGetSecurebits(err)
+	}
+
+	return uint(bits), nil
+}
+
+// SetSecurebits sets the securebits of all threads (Secbit flags). Setting
+// SecbitNoRoot and SecbitNoRootLocked, for example, makes becoming root grant
+// no capabilities. It needs cap.SETPCAP effective (see Requested), and locked
+// bits can't be changed anymore.
+func SetSecurebits(bits uint) error {
+	err := cap.Secbits(bits).Set()
+	if err != nil {
+		return couldNotSetSecurebits(bits, err)
+	}
+
+	return nil
+}
+
+// readSecurebits reads the securebits, and no_new_privs, through prctl.
+func readSecurebits() (Securebits, error) {
+	bits, err := GetSecurebits()
+	if err != nil {
+		return Securebits{}, err
+	}
+	nnp, err := cap.Prctl(unix.PR_GET_NO_NEW_PRIVS, 0, 0, 0, 0)
+	if err != nil {
+		return Securebits{}, couldNotGetSecurebits(err)
+	}
+
+	secbits := cap.Secbits(bits)
+
+	return Securebits{
+		NoRoot:                  secbits&cap.SecbitNoRoot != 0,
+		NoRootLocked:            secbits&cap.SecbitNoRootLocked != 0,
+		NoSetuidFixup:           secbits&cap.SecbitNoSetUIDFixup != 0,
+		NoSetuidFixupLocked:     secbits&cap.SecbitNoSetUIDFixupLocked != 0,
+		KeepCaps:                secbits&cap.SecbitKeepCaps != 0,
+		KeepCapsLocked:          secbits&cap.SecbitKeepCapsLocked != 0,
+		NoCapAmbientRaise:       secbits&cap.SecbitNoCapAmbientRaise != 0,
+		NoCapAmbientRaiseLocked: secbits&cap.SecbitNoCapAmbientRaiseLocked != 0,
+		NoNewPrivs:              nnp == 1,
+	}, nil
+}
+
+// EnableNoNewPrivs sets no_new_privs, for all threads, so exec()ed programs can
+// never gain privileges through setuid, setgid or file capabilities. It can't
+// be undone. Ambient capabilities (see SetAmbient) still reach exec()ed
+// programs, but privileged helpers (see KeepBounded) won't gain anything.
+// Nothing is set in a dry run (see DryRun).
+func (c *Capabilities) EnableNoNewPrivs() error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	if c.dryRun {
+		if !c.opts.quiet {
+			logger.Info("dry run, not setting no_new_privs", "pkg", pkgName)
+		}
+		return nil
+	}
+
+	err := setNoNewPrivs()
+	if err != nil {
+		return couldNotSetNoNewPrivs(err)
+	}
+
+	return nil
+}
+
+// lockDownSecurebits are the securebits set, and locked, by LockDown: becoming
+// root grants no capabilities, and neither do setuid transitions or ambient
+// capabilities.
+const lockDownSecurebits = SecbitNoRoot | SecbitNoRootLocked |
+	SecbitNoSetUIDFixup | SecbitNoSetUIDFixupLocked |
+	SecbitKeepCapsLocked |
+	SecbitNoCapAmbientRaise | SecbitNoCapAmbientRaiseLocked
+
+// LockDown clears, for good, all capabilities but the required ones from the
+// permitted set, and locks securebits so they can't be regained (not even by
+// becoming root). Afterwards only the Required ring keeps working: Privileged
+// and Requested return ErrLockedDown, and no capability can be required
+// anymore (see Seal). Setting securebits needs cap.SETPCAP permitted. Nothing
+// happens when bypassing. It must not be called from a ring callback.
+func (c *Capabilities) LockDown() error {
+	if managed, err := c.guard(); !managed {
+		return err
+	}
+
+	if c.holding() {
+		return couldNotLockDown(errors.New("called from a ring callback"))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.lockedDown {
+		return nil
+	}
+
+	// securebits are set first, while cap.SETPCAP is still permitted
+
+	_, err := c.transition(Requested, func(v cap.Value) bool { return v == cap.SETPCAP })
+	if err != nil {
+		return couldNotLockDown(err)
+	}
+	if c.dryRun {
+		logger.Info("dry run, not setting securebits", "pkg", pkgName, "securebits", lockDownSecurebits)
+	} else {
+		err = setSecurebits(lockDownSecurebits)
+	}
+	if err != nil {
+		_, _ = c.transition(Unprivileged, func(cap.Value) bool { return false })
+		return couldNotLockDown(err)
+	}
+
+	var dropped []cap.Value
+	for v := range c.all {
+		permitted, _ := c.have.GetFlag(cap.Permitted, v)
+		if permitted && !c.all[v][Required] {
+			dropped = append(dropped, v)
+		}
+	}
+	err = c.have.SetFlag(cap.Permitted, false, dropped...)
+	if err == nil {
+		err = c.have.SetFlag(cap.Inheritable, false, dropped...)
+	}
+	if err == nil {
+		_, err = c.transition(Unprivileged, func(cap.Value) bool { return false })
+	}
+	if err != nil {
+		c.stale = true // the cached permitted set is no longer the process one
+		return couldNotLockDown(err)
+	}
+
+	sortValues(dropped)
+	c.lockedDown = true
+	c.sealed = true
+	logger.Info("capabilities locked down", "pkg", pkgName, "dropped", capNames(dropped))
+
+	return nil
+}
+
+// writeNoNewPrivs sets no_new_privs through prctl, for all threads.
+func writeNoNewPrivs() error {
+	_, err := cap.Prctlw(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	return err
+}
+
+// ValidateAgainstSecurebits tells whether the given capabilities can be made
+// Effective given the current securebits. Capabilities not permitted can only
+// be gained by exec()ing a privileged program, which no_new_privs and noroot
+// forbid.
+func ValidateAgainstSecurebits(values []cap.Value) error {
+	var missing []cap.Value
+
+	sb, err := getSecurebits()
+	if err != nil {
+		return err
+	}
+
+	current := getThreadCaps()
+	for _, v := range values {
+		permitted, err := current.GetFlag(cap.Permitted, v)
+		if err != nil || !permitted {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	switch {
+	case sb.NoNewPrivs:
+		return couldNotValidateSecurebits(missing, "not permitted, and no_new_privs forbids gaining them")
+	case sb.NoRoot:
+		return couldNotValidateSecurebits(missing, "not permitted, and noroot forbids gaining them as root")
+	}
+
+	return couldNotValidateSecurebits(missing, "not permitted")
+}
+
+func couldNotGetSecurebits(e error) error {
+	return fmt.Errorf("could not get securebits: %w", e)
+}
+
+func couldNotSetSecurebits(bits uint, e error) error {
+	return fmt.Errorf("could not set securebits %#x: %w", bits, e)
+}
+
+func couldNotSetNoNewPrivs(e error) error {
+	return fmt.Errorf("could not set no_new_privs: %w", e)
+}
+
+func couldNotLockDown(e error) error {
+	return fmt.Errorf("could not lock down capabilities: %w", e)
+}
+
+func couldNotValidateSecurebits(values []cap.Value, reason string) error {
+	return fmt.Errorf("could not validate capabilities %v against securebits: %v", capNames(values), reason)
+}
@@ -0,0 +1,164 @@
+package capabilities
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestValidateAgainstSecurebits(t *testing.T) {
+	oldSecurebits, oldThreadCaps := getSecurebits, getThreadCaps
+	defer func() { getSecurebits, getThreadCaps = oldSecurebits, oldThreadCaps }()
+
+	thread := cap.NewSet()
+	require.NoError(t, thread.SetFlag(cap.Permitted, true, cap.BPF, cap.PERFMON))
+	getThreadCaps = func() *cap.Set { return thread }
+
+	testCases := []struct {
+		name       string
+		securebits Securebits
+		values     []cap.Value
+		err        string
+	}{
+		{
+			name:   "permitted",
+			values: []cap.Value{cap.BPF, cap.PERFMON},
+		},
+		{
+			name:       "permitted with no_new_privs",
+			securebits: Securebits{NoNewPrivs: true},
+			values:     []cap.Value{cap.BPF},
+		},
+		{
+			name:   "not permitted",
+			values: []cap.Value{cap.BPF, cap.SYS_ADMIN},
+			err:    "could not validate capabilities [cap_sys_admin] against securebits: not permitted",
+		},
+		{
+			name:       "not permitted with no_new_privs",
+			securebits: Securebits{NoNewPrivs: true, NoRoot: true},
+			values:     []cap.Value{cap.SYS_ADMIN},
+			err:        "could not validate capabilities [cap_sys_admin] against securebits: not permitted, and no_new_privs forbids gaining them",
+		},
+		{
+			name:       "not permitted with noroot",
+			securebits: Securebits{NoRoot: true, NoRootLocked: true},
+			values:     []cap.Value{cap.SYS_ADMIN},
+			err:        "could not validate capabilities [cap_sys_admin] against securebits: not permitted, and noroot forbids gaining them as root",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			securebits := tc.securebits
+			getSecurebits = func() (Securebits, error) { return securebits, nil }
+
+			err := ValidateAgainstSecurebits(tc.values)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	getSecurebits = func() (Securebits, error) { return Securebits{KeepCaps: true}, nil }
+	c := newFakeCapabilities(t)
+	require.NotNil(t, c.Info().Securebits)
+	assert.True(t, c.Info().Securebits.KeepCaps)
+}
+
+func TestSecurebitsState(t *testing.T) {
+	_, err := SecurebitsState()
+	assert.NoError(t, err)
+}
+
+func TestNoNewPrivs(t *testing.T) {
+	old := setNoNewPrivs
+	defer func() { setNoNewPrivs = old }()
+	calls := 0
+	setNoNewPrivs = func() error {
+		calls++
+		return nil
+	}
+
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN)
+	require.NoError(t, (&Capabilities{backend: b}).initialize(false))
+	assert.Zero(t, calls)
+	require.NoError(t, (&Capabilities{backend: b}).initialize(false, NoNewPrivs(true)))
+	assert.Equal(t, 1, calls)
+
+	setNoNewPrivs = func() error { return errors.New("operation not permitted") }
+	err := (&Capabilities{backend: b}).initialize(false, NoNewPrivs(true))
+	assert.EqualError(t, err, "could not set no_new_privs: operation not permitted")
+
+	assert.NoError(t, (&Capabilities{bypass: true}).EnableNoNewPrivs())
+}
+
+func TestSetSecurebits(t *testing.T) {
+	c := newTestCapabilities(t)
+
+	bits, err := GetSecurebits()
+	require.NoError(t, err)
+	sb, err := readSecurebits()
+	require.NoError(t, err)
+	assert.Equal(t, sb.NoRoot, bits&SecbitNoRoot != 0)
+	assert.Equal(t, sb.KeepCaps, bits&SecbitKeepCaps != 0)
+
+	err = SetSecurebits(bits) // cap.SETPCAP is not effective
+	assert.ErrorContains(t, err, "could not set securebits")
+
+	requirePermitted(t, cap.SETPCAP)
+	err = c.Requested(func() error {
+		return SetSecurebits(bits) // unchanged
+	}, cap.SETPCAP)
+	require.NoError(t, err)
+}
+
+func TestLockDown(t *testing.T) {
+	old := setSecurebits
+	defer func() { setSecurebits = old }()
+	var bits []uint
+	setSecurebits = func(b uint) error {
+		bits = append(bits, b)
+		return nil
+	}
+
+	b := newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN, cap.SETPCAP)
+	c := &Capabilities{backend: b}
+	require.NoError(t, c.initialize(false))
+	required := c.ListRequired()
+
+	require.NoError(t, c.LockDown())
+	assert.Equal(t, []uint{lockDownSecurebits}, bits)
+	assert.Equal(t, required, stateOf(b.set).Permitted)
+	assert.Empty(t, b.effective())
+
+	err := c.Privileged(func() error { return nil })
+	assert.ErrorIs(t, err, ErrLockedDown)
+	assert.EqualError(t, err, "could not enter privileged ring: capabilities locked down")
+	assert.ErrorIs(t, c.Requested(func() error { return nil }, cap.BPF), ErrLockedDown)
+	_, err = c.EnterRequested(cap.BPF)
+	assert.ErrorIs(t, err, ErrLockedDown)
+	_, err = c.TransitionTo(Privileged)
+	assert.ErrorIs(t, err, ErrLockedDown)
+	assert.Error(t, c.Require(cap.NET_ADMIN))
+
+	require.NoError(t, c.Required(func() error {
+		assert.Equal(t, required, b.effective())
+		return nil
+	}))
+	assert.NoError(t, c.LockDown())
+	assert.Len(t, bits, 1)
+
+	setSecurebits = func(uint) error { return errors.New("operation not permitted") }
+	c = &Capabilities{backend: newFakeBackend(t, cap.IPC_LOCK, cap.SYS_RESOURCE, cap.BPF, cap.PERFMON, cap.SYS_ADMIN, cap.NET_ADMIN, cap.SETPCAP)}
+	require.NoError(t, c.initialize(false))
+	assert.EqualError(t, c.LockDown(), "could not lock down capabilities: operation not permitted")
+	assert.NoError(t, c.Requested(func() error { return nil }, cap.SYS_ADMIN))
+
+	assert.NoError(t, (&Capabilities{bypass: true}).LockDown())
+}
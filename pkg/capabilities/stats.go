@@ -0,0 +1,188 @@
+package capabilities
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+// Stats are counters of the capabilities changes since initialization.
+type Stats struct {
+	Transitions map[string]uint64        `json:"transitions"` // times each ring was entered
+	TimeInRing  map[string]time.Duration `json:"timeInRing"`  // time spent in each ring
+	SetProcs    uint64                   `json:"setProcs"`    // successful process capabilities changes
+	Enabled     map[string]uint64        `json:"enabled"`     // times each capability was raised
+	Dropped     uint64                   `json:"dropped"`     // ring events not delivered to slow subscribers
+}
+
+// Metrics is a sink of ring transitions, for external metrics systems. It is
+// called while holding the capabilities lock: it must be cheap and must not
+// call back into the capabilities package. Counts of transitions per ring are
+// also available through Stats.
+type Metrics interface {
+	RingEntered(t Ring)                   // a ring was entered
+	RingDuration(t Ring, d time.Duration) // time spent in a ring just left
+}
+
+// counters are the internal, lock protected, source of Stats.
+type counters struct {
+	transitions map[Ring]uint64
+	timeInRing  map[Ring]time.Duration
+	setProcs    uint64
+	enabled     map[cap.Value]uint64
+	ring        Ring      // current ring
+	since       time.Time // when the current ring was entered
+}
+
+// Stats returns the counters of the capabilities changes. It can be called from
+// within a ring callback. Counters are empty if not initialized.
+func (c *Capabilities) Stats() Stats {
+	stats := Stats{
+		Transitions: make(map[string]uint64),
+		TimeInRing:  make(map[string]time.Duration),
+		Enabled:     make(map[string]uint64),
+	}
+
+	if !c.initialized() || c.bypass {
+		return stats
+	}
+
+	runlock := c.rlock()
+	defer runlock()
+
+	for t, n := range c.counters.transitions {
+		stats.Transitions[t.String()] = n
+	}
+	for t, d := range c.counters.timeInRing {
+		stats.TimeInRing[t.String()] = d
+	}
+	if !c.counters.since.IsZero() {
+		stats.TimeInRing[c.counters.ring.String()] += time.Since(c.counters.since)
+	}
+	for v, n := range c.counters.enabled {
+		stats.Enabled[NameOf(v)] = n
+	}
+	stats.SetProcs = c.counters.setProcs
+	stats.Dropped = c.droppedEvents()
+
+	return stats
+}
+
+// SetMetrics registers the given sink of ring transitions, replacing any
+// previous one (nil unregisters it). It does nothing if not initialized.
+func (c *Capabilities) SetMetrics(m Metrics) {
+	if !c.initialized() || c.bypass {
+		return
+	}
+
+	unlock := c.wlock()
+	defer unlock()
+
+	c.metrics = m
+}
+
+// countTransition accounts a transition into the given ring, raising the given
+// capabilities.
+func (c *Capabilities) countTransition(t Ring, raised []cap.Value) {
+	if c.counters.transitions == nil {
+		c.counters.transitions = make(map[Ring]uint64)
+		c.counters.timeInRing = make(map[Ring]time.Duration)
+		c.counters.enabled = make(map[cap.Value]uint64)
+	}
+
+	now := time.Now()
+	if !c.counters.since.IsZero() {
+		spent := now.Sub(c.counters.since)
+		c.counters.timeInRing[c.counters.ring] += spent
+		if c.metrics != nil {
+			c.metrics.RingDuration(c.counters.ring, spent)
+		}
+	}
+	c.counters.ring = t
+	c.counters.since = now
+	c.counters.transitions[t]++
+	if c.metrics != nil {
+		c.metrics.RingEntered(t)
+	}
+
+	for _, v := range raised {
+		c.counters.enabled[v]++
+	}
+}
+
+// WriteMetrics writes the capabilities stats (see Stats) in the OpenMetrics
+// text exposition format, so a minimal HTTP handler can expose them.
+func (c *Capabilities) WriteMetrics(w io.Writer) error {
+	if !c.initialized() {
+		return couldNotUseUninitialized()
+	}
+
+	stats := c.Stats()
+
+	var b strings.Builder
+
+	family(&b, "tracee_capabilities_ring_transitions", "counter", "Times each capabilities ring was entered.")
+	for _, ring := range sortedKeys(stats.Transitions) {
+		fmt.Fprintf(&b, "tracee_capabilities_ring_transitions_total{ring=\"%s\"} %d\n", escape(ring), stats.Transitions[ring])
+	}
+
+	family(&b, "tracee_capabilities_ring_seconds", "counter", "Time spent in each capabilities ring.")
+	rings := make([]string, 0, len(stats.TimeInRing))
+	for ring := range stats.TimeInRing {
+		rings = append(rings, ring)
+	}
+	sort.Strings(rings)
+	for _, ring := range rings {
+		fmt.Fprintf(&b, "tracee_capabilities_ring_seconds_total{ring=\"%s\"} %g\n", escape(ring), stats.TimeInRing[ring].Seconds())
+	}
+
+	family(&b, "tracee_capabilities_setproc", "counter", "Successful changes of the process capabilities.")
+	fmt.Fprintf(&b, "tracee_capabilities_setproc_total %d\n", stats.SetProcs)
+
+	family(&b, "tracee_capabilities_enabled", "counter", "Times each capability was raised to effective.")
+	for _, name := range sortedKeys(stats.Enabled) {
+		fmt.Fprintf(&b, "tracee_capabilities_enabled_total{cap=\"%s\"} %d\n", escape(name), stats.Enabled[name])
+	}
+
+	family(&b, "tracee_capabilities_events_dropped", "counter", "Ring events not delivered to slow subscribers.")
+	fmt.Fprintf(&b, "tracee_capabilities_events_dropped_total %d\n", stats.Dropped)
+
+	b.WriteString("# EOF\n")
+
+	_, err := io.WriteString(w, b.String())
+	if err != nil {
+		return couldNotWriteMetrics(err)
+	}
+
+	return nil
+}
+
+// family writes the metadata lines of a metric family.
+func family(b *strings.Builder, name string, typ string, help string) {
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+	fmt.Fprintf(b, "# HELP %s %s\n", name, escape(help))
+}
+
+// escape escapes label values and help texts as required by the exposition
+// format.
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func couldNotWriteMetrics(e error) error {
+	return fmt.Errorf("could not write capabilities metrics: %w", e)
+}
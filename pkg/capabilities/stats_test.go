@@ -0,0 +1,115 @@
+package capabilities
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestStats(t *testing.T) {
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+	before := c.Stats()
+	require.NoError(t, c.Requested(func() error { return nil }, cap.NET_ADMIN))
+	after := c.Stats()
+
+	assert.Equal(t, before.Transitions["requested"]+1, after.Transitions["requested"])
+	assert.Equal(t, before.Transitions["unprivileged"]+1, after.Transitions["unprivileged"])
+	assert.Equal(t, before.Enabled["cap_net_admin"]+1, after.Enabled["cap_net_admin"])
+	assert.Equal(t, before.SetProcs+2, after.SetProcs)
+	assert.NotZero(t, after.TimeInRing["unprivileged"])
+}
+
+func TestWriteMetrics(t *testing.T) {
+	c := newFakeCapabilities(t)
+	c.countTransition(Required, []cap.Value{cap.BPF, cap.PERFMON})
+	c.countTransition(Unprivileged, nil)
+	c.countTransition(Required, []cap.Value{cap.BPF, cap.PERFMON})
+	c.counters.setProcs = 3
+
+	var buf bytes.Buffer
+	require.NoError(t, c.WriteMetrics(&buf))
+	out := buf.String()
+
+	assertOpenMetrics(t, out)
+	assert.Contains(t, out, `tracee_capabilities_ring_transitions_total{ring="required"} 2`+"\n")
+	assert.Contains(t, out, `tracee_capabilities_ring_transitions_total{ring="unprivileged"} 1`+"\n")
+	assert.Contains(t, out, "tracee_capabilities_setproc_total 3\n")
+	assert.Contains(t, out, `tracee_capabilities_enabled_total{cap="cap_bpf"} 2`+"\n")
+
+	assert.Equal(t, `a\\b\"c\nd`, escape("a\\b\"c\nd"))
+}
+
+// assertOpenMetrics checks the given output against the OpenMetrics text
+// format: metadata precedes the samples of its family, samples are well formed
+// and the output ends with an EOF marker.
+func assertOpenMetrics(t *testing.T, out string) {
+	t.Helper()
+
+	metadata := regexp.MustCompile(`^# (TYPE|HELP) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.*)$`)
+	sample := regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{([a-zA-Z_][a-zA-Z0-9_]*="([^"\\\n]|\\[\\"n])*"(,[a-zA-Z_][a-zA-Z0-9_]*="([^"\\\n]|\\[\\"n])*")*)?\})? (-?[0-9.e+-]+|NaN|[+-]Inf)$`)
+
+	require.True(t, strings.HasSuffix(out, "# EOF\n"), "missing EOF marker")
+	lines := strings.Split(strings.TrimSuffix(out, "# EOF\n"), "\n")
+	lines = lines[:len(lines)-1] // trailing newline
+
+	types := make(map[string]string)
+	current := ""
+	for _, line := range lines {
+		if m := metadata.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				_, seen := types[m[2]]
+				require.False(t, seen, "family %v declared twice", m[2])
+				types[m[2]] = m[3]
+				current = m[2]
+			}
+			require.Equal(t, current, m[2], "metadata out of family: %v", line)
+			continue
+		}
+		m := sample.FindStringSubmatch(line)
+		require.NotNil(t, m, "invalid sample: %q", line)
+		name := m[1]
+		if types[current] == "counter" {
+			require.Equal(t, current+"_total", name, "counter sample out of family: %v", line)
+		}
+	}
+}
+
+// recordingMetrics is a Metrics sink recording what it is given.
+type recordingMetrics struct {
+	entered   []Ring
+	durations map[Ring]int
+}
+
+func (m *recordingMetrics) RingEntered(t Ring) {
+	m.entered = append(m.entered, t)
+}
+
+func (m *recordingMetrics) RingDuration(t Ring, d time.Duration) {
+	m.durations[t]++
+}
+
+func TestSetMetrics(t *testing.T) {
+	c := newFakeCapabilities(t)
+	c.countTransition(Unprivileged, nil)
+
+	m := &recordingMetrics{durations: make(map[Ring]int)}
+	c.SetMetrics(m)
+	c.countTransition(Required, nil)
+	c.countTransition(Unprivileged, nil)
+	c.countTransition(Privileged, nil)
+
+	assert.Equal(t, []Ring{Required, Unprivileged, Privileged}, m.entered)
+	assert.Equal(t, map[Ring]int{Unprivileged: 2, Required: 1}, m.durations)
+
+	c.SetMetrics(nil)
+	c.countTransition(Unprivileged, nil)
+	assert.Len(t, m.entered, 3)
+	assert.Equal(t, uint64(3), c.Stats().Transitions["unprivileged"])
+}
@@ -0,0 +1,43 @@
+package capabilities
+
+import "kernel.org/pub/linux/libs/security/libcap/cap"
+
+// PrivilegedValue is like Privileged() but returns the value of the callback.
+// Go methods can't have type parameters, so this is a function.
+func PrivilegedValue[T any](c *Capabilities, cb func() (T, error)) (T, error) {
+	var value T
+
+	err := c.Privileged(func() error {
+		var err error
+		value, err = cb()
+		return err
+	})
+
+	return value, err
+}
+
+// RequiredValue is like Required() but returns the value of the callback.
+func RequiredValue[T any](c *Capabilities, cb func() (T, error)) (T, error) {
+	var value T
+
+	err := c.Required(func() error {
+		var err error
+		value, err = cb()
+		return err
+	})
+
+	return value, err
+}
+
+// RequestedValue is like Requested() but returns the value of the callback.
+func RequestedValue[T any](c *Capabilities, cb func() (T, error), values ...cap.Value) (T, error) {
+	var value T
+
+	err := c.Requested(func() error {
+		var err error
+		value, err = cb()
+		return err
+	}, values...)
+
+	return value, err
+}
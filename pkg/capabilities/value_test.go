@@ -0,0 +1,29 @@
+package capabilities
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
+)
+
+func TestRequestedValue(t *testing.T) {
+	c, _ := newFakeProcess(t, []cap.Value{cap.NET_ADMIN})
+
+	ring, err := RequestedValue(c, func() (Ring, error) {
+		return c.EffectiveRing(), nil
+	}, cap.NET_ADMIN)
+	require.NoError(t, err)
+	assert.Equal(t, Requested, ring)
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+
+	failure := errors.New("failure")
+	n, err := RequiredValue(c, func() (int, error) {
+		return 42, failure
+	})
+	assert.ErrorIs(t, err, failure)
+	assert.Equal(t, 42, n)
+	assert.Equal(t, Unprivileged, c.EffectiveRing())
+}
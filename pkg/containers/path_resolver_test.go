@@ -1,6 +1,7 @@
 package containers
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"testing/fstest"
@@ -65,7 +66,9 @@ func TestPathResolver_ResolveAbsolutePath(t *testing.T) {
 		testFilePath := "/tmp/tmp.so"
 
 		err := capabilities.Initialize(true) // initialize capabilities
-		assert.NoError(t, err)
+		if !errors.Is(err, capabilities.ErrAlreadyInitialized) {
+			assert.NoError(t, err)
+		}
 
 		for _, testCase := range testCases {
 			t.Run(testCase.Name, func(t *testing.T) {
@@ -263,6 +263,93 @@ func (t *Tracee) handleEventsDependencies(eventId events.ID) {
 	}
 }
 
+// selectEvents adds, to the essential events, the pseudo events added by
+// capture, the events chosen by the user and all their dependencies.
+func (t *Tracee) selectEvents() {
+	// Pseudo events added by capture
+	for eventID, eCfg := range GetCaptureEventsList(t.config) {
+		t.events[eventID] = eCfg
+	}
+
+	// Events chosen by the user
+	for _, e := range t.config.Filter.EventsToTrace {
+		t.events[e] = eventConfig{submit: true, emit: true}
+	}
+
+	// Handles all essential events dependencies
+	for id := range t.events {
+		t.handleEventsDependencies(id)
+	}
+}
+
+// eventsCapabilities returns the capabilities needed by the selected events.
+func (t *Tracee) eventsCapabilities() ([]cap.Value, error) {
+	var values []cap.Value
+
+	for id := range t.events {
+		evt, ok := events.Definitions.GetSafe(id)
+		if !ok {
+			return nil, fmt.Errorf("could not get event")
+		}
+		values = append(values, evt.Dependencies.Capabilities...)
+	}
+
+	return values, nil
+}
+
+// netEnabled tells whether the network related eBPF programs are needed.
+func (t *Tracee) netEnabled() bool {
+	return t.config.Capture.NetIfaces != nil || len(t.config.Filter.NetFilter.Interfaces()) != 0
+}
+
+// RequiredCapabilities returns, sorted, the capabilities tracee requires on the
+// running host for the given configuration: the ones of the selected events
+// (and their dependencies), cap.NET_ADMIN for network probes and the ones added
+// by the user, on top of the ones decided at initialization (see
+// capabilities.MinimalCapsFor), but for the ones dropped by the user.
+func RequiredCapabilities(cfg Config) ([]cap.Value, error) {
+	t := &Tracee{
+		config: cfg,
+		events: GetEssentialEventsList(),
+	}
+	t.selectEvents()
+
+	values, err := t.eventsCapabilities()
+	if err != nil {
+		return nil, err
+	}
+	if t.netEnabled() {
+		values = append(values, cap.NET_ADMIN) // see probes.Init
+	}
+	capsToAdd, err := capabilities.ReqByString(cfg.Capabilities.AddCaps...)
+	if err != nil {
+		return nil, err
+	}
+	values = append(values, capsToAdd...)
+
+	required, err := capabilities.MinimalCapsFor(capabilities.BaseRequired(values...))
+	if err != nil {
+		return nil, err
+	}
+
+	capsToDrop, err := capabilities.ReqByString(cfg.Capabilities.DropCaps...)
+	if err != nil {
+		return nil, err
+	}
+	dropped := make(map[cap.Value]bool)
+	for _, v := range capsToDrop {
+		dropped[v] = true
+	}
+	kept := []cap.Value{}
+	for _, v := range required {
+		if !dropped[v] {
+			kept = append(kept, v)
+		}
+	}
+
+	return kept, nil
+}
+
 // New creates a new Tracee instance based on a given valid Config
 // It is expected that New will not cause external system side effects (reads, writes, etc.)
 func New(cfg Config) (*Tracee, error) {
@@ -286,31 +373,17 @@ func New(cfg Config) (*Tracee, error) {
 	}
 	caps := capabilities.GetInstance()
 
-	// Pseudo events added by capture
-	for eventID, eCfg := range GetCaptureEventsList(cfg) {
-		t.events[eventID] = eCfg
-	}
-
-	// Events chosen by the user
-	for _, e := range t.config.Filter.EventsToTrace {
-		t.events[e] = eventConfig{submit: true, emit: true}
-	}
-
-	// Handles all essential events dependencies
-	for id := range t.events {
-		t.handleEventsDependencies(id)
-	}
+	t.selectEvents()
 
 	// Add Required (by enabled events) capabilities to its ring
 
-	for id := range t.events {
-		evt, ok := events.Definitions.GetSafe(id)
-		if !ok {
-			return t, fmt.Errorf("could not get event")
-		}
-		for _, capArray := range evt.Dependencies.Capabilities {
-			caps.Require(capArray)
-		}
+	eventsCaps, err := t.eventsCapabilities()
+	if err != nil {
+		return t, err
+	}
+	err = caps.Require(eventsCaps...)
+	if err != nil {
+		return t, err
 	}
 
 	// Add/Drop Required (by the user) capabilities to/from its ring
@@ -328,11 +401,23 @@ func New(cfg Config) (*Tracee, error) {
 	if err != nil {
 		return t, err
 	}
-	err = caps.Unrequire(capsToDrop...)
+	err = caps.ForceUnrequire(capsToDrop...)
 	if err != nil {
 		return t, err
 	}
 
+	// Fail fast if required capabilities (once added and dropped) are not permitted
+
+	err = caps.Validate()
+	if err != nil {
+		return t, err
+	}
+	if caps.IsBypass() {
+		logger.Debug("capabilities bypassed, none dropped")
+	} else {
+		logger.Debug("required capabilities", "caps", fmt.Sprint(caps.ListRequired()))
+	}
+
 	// Configure network interfaces map (TODO: remove this with cgroup/skb code)
 
 	t.netInfo.ifaces = make(map[int]*net.Interface)
@@ -1139,8 +1224,6 @@ func (t *Tracee) attachProbes() error {
 func (t *Tracee) initBPF() error {
 
 	var err error
-	isCaptureNetSet := t.config.Capture.NetIfaces != nil
-	isFilterNetSet := len(t.config.Filter.NetFilter.Interfaces()) != 0
 
 	// Execute code with higher privileges: ring1 (required)
 
@@ -1162,9 +1245,7 @@ func (t *Tracee) initBPF() error {
 
 		// Initialize probes
 
-		netEnabled := isCaptureNetSet || isFilterNetSet
-
-		t.probes, err = probes.Init(t.bpfModule, netEnabled)
+		t.probes, err = probes.Init(t.bpfModule, t.netEnabled())
 		if err != nil {
 			return err
 		}
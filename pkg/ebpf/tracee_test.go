@@ -13,6 +13,7 @@ import (
 	"github.com/aquasecurity/tracee/pkg/events"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"kernel.org/pub/linux/libs/security/libcap/cap"
 )
 
 func Test_updateProfile(t *testing.T) {
@@ -179,3 +180,49 @@ func Test_getTailCalls(t *testing.T) {
 		})
 	}
 }
+
+func TestRequiredCapabilities(t *testing.T) {
+	testCases := []struct {
+		name        string
+		ifaces      []string
+		expected    []cap.Value
+		notExpected []cap.Value
+	}{
+		{
+			name:        "events and added capabilities",
+			expected:    []cap.Value{cap.SYS_PTRACE, cap.KILL},
+			notExpected: []cap.Value{cap.SYS_RESOURCE, cap.NET_ADMIN},
+		},
+		{
+			name:        "network filter",
+			ifaces:      []string{"lo"},
+			expected:    []cap.Value{cap.SYS_PTRACE, cap.KILL, cap.NET_ADMIN},
+			notExpected: []cap.Value{cap.SYS_RESOURCE},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Filter: &Filter{
+					EventsToTrace: []events.ID{events.InitNamespaces},
+					NetFilter:     &NetIfaces{Ifaces: tc.ifaces},
+				},
+				Capture: &CaptureConfig{},
+				Capabilities: &CapabilitiesConfig{
+					AddCaps:  []string{"cap_kill"},
+					DropCaps: []string{"cap_sys_resource"},
+				},
+			}
+
+			values, err := RequiredCapabilities(cfg)
+			require.NoError(t, err)
+			for _, v := range tc.expected {
+				assert.Contains(t, values, v)
+			}
+			for _, v := range tc.notExpected {
+				assert.NotContains(t, values, v)
+			}
+		})
+	}
+}